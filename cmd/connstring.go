@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/k8s-config-connector/pkg/clients/generated/apis/sql/v1beta1"
+	core_v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/nais/sqeletor/internal/controller"
+)
+
+// runConnstring implements `sqeletor connstring <namespace>/<user>`, printing the URL sqeletor
+// would generate for the SQLUser based on the live cluster state.
+func runConnstring(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("connstring", flag.ContinueOnError)
+	flags.SetOutput(out)
+	reveal := flags.Bool("reveal", false, "Show the password instead of redacting it.")
+	defaultsFile := flags.String("defaults-file", "", "Path to the defaults file used by the controller, if any.")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: sqeletor connstring [flags] <namespace>/<user>")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return fmt.Errorf("expected exactly one <namespace>/<user> argument")
+	}
+
+	namespace, name, ok := strings.Cut(flags.Arg(0), "/")
+	if !ok || namespace == "" || name == "" {
+		return fmt.Errorf("invalid argument %q, expected <namespace>/<user>", flags.Arg(0))
+	}
+
+	defaults := controller.Defaults{}
+	if *defaultsFile != "" {
+		loaded, err := controller.LoadDefaults(*defaultsFile)
+		if err != nil {
+			return err
+		}
+		defaults = loaded
+	}
+
+	config, err := ctrl.GetConfig()
+	if err != nil {
+		return fmt.Errorf("unable to get kubeconfig: %w", err)
+	}
+	c, err := client.New(config, client.Options{Scheme: scheme})
+	if err != nil {
+		return fmt.Errorf("unable to create client: %w", err)
+	}
+
+	connString, err := connectionString(context.Background(), c, types.NamespacedName{Namespace: namespace, Name: name}, defaults, *reveal)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(out, connString)
+	return nil
+}
+
+// connectionString returns the URL for the SQLUser, with the password redacted unless reveal is set.
+func connectionString(ctx context.Context, c client.Client, key types.NamespacedName, defaults controller.Defaults, reveal bool) (string, error) {
+	sqlUser := &v1beta1.SQLUser{}
+	if err := c.Get(ctx, key, sqlUser); err != nil {
+		return "", fmt.Errorf("failed to get SQLUser: %w", err)
+	}
+
+	instanceKey := types.NamespacedName{Name: sqlUser.Spec.InstanceRef.Name, Namespace: key.Namespace}
+	if sqlUser.Spec.InstanceRef.Namespace != "" {
+		instanceKey.Namespace = sqlUser.Spec.InstanceRef.Namespace
+	}
+	sqlInstance := &v1beta1.SQLInstance{}
+	if err := c.Get(ctx, instanceKey, sqlInstance); err != nil {
+		return "", fmt.Errorf("failed to get SQLInstance: %w", err)
+	}
+
+	// the password is only known once the secret has been written, render an empty one until then
+	password := ""
+	if ref := sqlUser.Spec.Password; ref != nil && ref.ValueFrom != nil && ref.ValueFrom.SecretKeyRef != nil {
+		secret := &core_v1.Secret{}
+		err := c.Get(ctx, types.NamespacedName{Name: ref.ValueFrom.SecretKeyRef.Name, Namespace: key.Namespace}, secret)
+		if client.IgnoreNotFound(err) != nil {
+			return "", fmt.Errorf("failed to get secret: %w", err)
+		}
+		if !apierrors.IsNotFound(err) {
+			password = string(secret.Data[ref.ValueFrom.SecretKeyRef.Key])
+		}
+	}
+
+	connURL, err := controller.ConnectionURL(sqlUser, sqlInstance, password, defaults)
+	if err != nil {
+		return "", err
+	}
+	if reveal {
+		return connURL.String(), nil
+	}
+	return connURL.Redacted(), nil
+}
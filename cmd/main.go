@@ -1,21 +1,37 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"flag"
+	"fmt"
+	"net"
+	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 
+	"go.uber.org/zap/zapcore"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/metrics/filters"
 	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
 
 	"github.com/GoogleCloudPlatform/k8s-config-connector/pkg/clients/generated/apis/sql/v1beta1"
 	"github.com/nais/sqeletor/internal/controller"
@@ -35,21 +51,120 @@ func init() {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "connstring" {
+		if err := runConnstring(os.Args[2:], os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	var metricsAddr string
 	var enableLeaderElection bool
 	var probeAddr string
 	var enableHTTP2 bool
+	var secureMetrics bool
+	var labelSelector string
+	var defaultsFile string
+	var maxURLLength int
+	var maxEgressPeers int
+	var namespaceTeamLabel string
+	var strictOwnership bool
+	var noOwnerRefs bool
+	var netpolSweepInterval time.Duration
+	var resourceMetricLabels bool
+	var enableWebhooks bool
+	var certExpiryThreshold time.Duration
+	var adminAddr string
+	var adminTokenFile string
+	var adminCertFile string
+	var adminKeyFile string
+	var logLevel string
+	var logFormat string
+	var legacyValidation bool
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
+	flag.BoolVar(&secureMetrics, "metrics-secure", false,
+		"If set, the metrics endpoint is served over HTTPS and requires authentication and authorization.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
+	flag.StringVar(&labelSelector, "label-selector", "",
+		"Only reconcile resources matching this label selector. Defaults to all resources.")
+	flag.StringVar(&defaultsFile, "defaults-file", "",
+		"Path to a YAML file with cluster wide defaults for resource annotations. Reloaded on change.")
+	flag.IntVar(&maxURLLength, "max-url-length", 2048,
+		"Emit a warning event when a generated connection URL is longer than this.")
+	flag.IntVar(&maxEgressPeers, "max-egress-peers", controller.DefaultMaxEgressPeers,
+		"Maximum number of instance ips a network policy allows egress to. Private ips are kept over public ones.")
+	flag.StringVar(&namespaceTeamLabel, "namespace-team-label", "team",
+		"Namespace label to take the team from when a SQLUser has no team label.")
+	flag.BoolVar(&strictOwnership, "strict-ownership", false,
+		"If set, managed labels changed by others are reported with a warning event when they are reset.")
+	flag.BoolVar(&noOwnerRefs, "no-owner-refs", false,
+		"Record the owners of secrets in an annotation instead of owner references, cleaning them up with a finalizer. "+
+			"For secrets also tracked by GitOps tools which conflict with foreign owner references.")
+	flag.DurationVar(&netpolSweepInterval, "netpol-sweep-interval", time.Hour,
+		"How often to delete managed network policies whose SQLInstance no longer exists. Set to 0 to disable.")
+	flag.BoolVar(&resourceMetricLabels, "resource-metric-labels", false,
+		"Label the reconcile metrics with the team and app of the resource. "+
+			"Adds a series per app, so only enable it where the metrics backend can take the cardinality.")
+	flag.BoolVar(&enableWebhooks, "enable-webhooks", false,
+		"Serve the validating webhooks rejecting SQLSSLCerts claiming a secret already claimed by another SQLSSLCert, "+
+			"and SQLUsers using an env var prefix already used by another SQLUser in the same secret. "+
+			"Requires a serving certificate and a ValidatingWebhookConfiguration.")
+	flag.DurationVar(&certExpiryThreshold, "cert-expiry-threshold", controller.DefaultCertExpiryThreshold,
+		"Count SQLSSLCert certificates expiring within this duration in the sqeletor_certs_expiring_soon metric.")
+	flag.StringVar(&adminAddr, "admin-bind-address", "",
+		"The address the admin endpoint for triggering reconciles and listing managed resources binds to. "+
+			"Disabled if empty, requires --admin-token-file. Only the leader serves it, as only the leader reconciles, "+
+			"so with --leader-elect the other replicas refuse connections.")
+	flag.StringVar(&adminTokenFile, "admin-token-file", "",
+		"Path to a file with the bearer token required by the admin endpoint.")
+	flag.StringVar(&adminCertFile, "admin-cert-file", "",
+		"Path to the certificate the admin endpoint is served over HTTPS with. "+
+			"Without it, the admin endpoint may only bind to localhost, to keep the bearer token off the network.")
+	flag.StringVar(&adminKeyFile, "admin-key-file", "",
+		"Path to the private key of --admin-cert-file.")
+	flag.StringVar(&logLevel, "log-level", "",
+		"Log level, either a name like info or debug, or a verbosity like 4 to include logger.V(4). Overrides --zap-log-level.")
+	flag.StringVar(&logFormat, "log-format", "",
+		"Log format, json or console. Overrides --zap-encoder.")
+	flag.BoolVar(&legacyValidation, "legacy-validation", true,
+		"Keep accepting resources that earlier releases accepted, with a warning event: SQLInstances without an app label "+
+			"and SQLUsers with env var prefixes that aren't valid env var names. "+
+			"Deprecated, will default to false and then be removed in a future release.")
 	opts := zap.Options{}
 	opts.BindFlags(flag.CommandLine)
 	flag.Parse()
 
+	if err := applyLogFlags(&opts, logLevel, logFormat); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
 
+	selector, err := labels.Parse(labelSelector)
+	if err != nil {
+		setupLog.Error(err, "unable to parse label selector")
+		os.Exit(1)
+	}
+
+	var trigger *controller.ReconcileTrigger
+	var adminToken string
+	if adminAddr != "" {
+		adminToken, err = readAdminToken(adminTokenFile)
+		if err != nil {
+			setupLog.Error(err, "unable to read admin token")
+			os.Exit(1)
+		}
+		if err := checkAdminAddress(adminAddr, adminCertFile, adminKeyFile); err != nil {
+			setupLog.Error(err, "unable to serve admin endpoint")
+			os.Exit(1)
+		}
+		trigger = &controller.ReconcileTrigger{}
+	}
+
 	// if the enable-http2 flag is false (the default), http/2 should be disabled
 	// due to its vulnerabilities. More specifically, disabling http/2 will
 	// prevent from being vulnerable to the HTTP/2 Stream Cancellation and
@@ -67,11 +182,12 @@ func main() {
 	}
 
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
-		Scheme: scheme,
-		Metrics: metricsserver.Options{
-			BindAddress: metricsAddr,
-			TLSOpts:     tlsOpts,
-		},
+		Scheme:        scheme,
+		Metrics:       metricsServerOptions(metricsAddr, secureMetrics, tlsOpts),
+		WebhookServer: webhook.NewServer(webhook.Options{TLSOpts: tlsOpts}),
+		// PodMonitors are read as unstructured objects, which otherwise bypass the cache and hit the API server
+		// on every reconcile of an instance
+		Client:                 client.Options{Cache: &client.CacheOptions{Unstructured: true}},
 		HealthProbeBindAddress: probeAddr,
 		LeaderElection:         enableLeaderElection,
 		LeaderElectionID:       "c6b95081.sql.cnrm.cloud.google.com",
@@ -91,28 +207,113 @@ func main() {
 		setupLog.Error(err, "unable to start manager")
 		os.Exit(1)
 	}
+	if trigger != nil {
+		trigger.Reader = mgr.GetAPIReader()
+	}
+
+	if err := requireKinds(mgr.GetRESTMapper(), v1beta1.SQLSSLCertGVK, v1beta1.SQLUserGVK, v1beta1.SQLInstanceGVK); err != nil {
+		setupLog.Error(err, "unable to find the Config Connector SQL CRDs, are they installed?")
+		os.Exit(1)
+	}
 
 	if err = (&controller.SQLSSLCertReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
+		Client:               mgr.GetClient(),
+		Scheme:               mgr.GetScheme(),
+		Recorder:             mgr.GetEventRecorderFor("sqeletor"),
+		LabelSelector:        selector,
+		StrictOwnership:      strictOwnership,
+		NoOwnerReferences:    noOwnerRefs,
+		ResourceMetricLabels: resourceMetricLabels,
+		CertExpiryThreshold:  certExpiryThreshold,
+		Trigger:              trigger,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "SQLSSLCert")
 		os.Exit(1)
 	}
+	if enableWebhooks {
+		if err = (&controller.SQLSSLCertValidator{
+			Client:        mgr.GetAPIReader(),
+			LabelSelector: selector,
+		}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "SQLSSLCert")
+			os.Exit(1)
+		}
+		if err = (&controller.SQLUserValidator{
+			Client:        mgr.GetAPIReader(),
+			LabelSelector: selector,
+		}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "SQLUser")
+			os.Exit(1)
+		}
+	}
+	defaults := &controller.DefaultsHolder{}
+	if defaultsFile != "" {
+		loaded, err := controller.LoadDefaults(defaultsFile)
+		if err != nil {
+			setupLog.Error(err, "unable to load defaults")
+			os.Exit(1)
+		}
+		defaults.Set(loaded)
+		if err := mgr.Add(manager.RunnableFunc(func(ctx context.Context) error {
+			return defaults.Watch(ctx, defaultsFile)
+		})); err != nil {
+			setupLog.Error(err, "unable to watch defaults")
+			os.Exit(1)
+		}
+	}
+
 	if err = (&controller.SQLUserReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
+		Client:               mgr.GetClient(),
+		Scheme:               mgr.GetScheme(),
+		Recorder:             mgr.GetEventRecorderFor("sqeletor"),
+		LabelSelector:        selector,
+		Defaults:             defaults,
+		MaxURLLength:         maxURLLength,
+		NamespaceTeamLabel:   namespaceTeamLabel,
+		StrictOwnership:      strictOwnership,
+		NoOwnerReferences:    noOwnerRefs,
+		ResourceMetricLabels: resourceMetricLabels,
+		Trigger:              trigger,
+		LegacyValidation:     legacyValidation,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "SQLUser")
 		os.Exit(1)
 	}
 	if err = (&controller.SQLInstanceReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
+		Client:               mgr.GetClient(),
+		Scheme:               mgr.GetScheme(),
+		Recorder:             mgr.GetEventRecorderFor("sqeletor"),
+		LabelSelector:        selector,
+		StrictOwnership:      strictOwnership,
+		ResourceMetricLabels: resourceMetricLabels,
+		Trigger:              trigger,
+		MaxEgressPeers:       maxEgressPeers,
+		LegacyValidation:     legacyValidation,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "SQLInstance")
 		os.Exit(1)
 	}
+	if netpolSweepInterval > 0 {
+		if err := mgr.Add(&controller.NetpolSweeper{
+			Client:   mgr.GetClient(),
+			Interval: netpolSweepInterval,
+		}); err != nil {
+			setupLog.Error(err, "unable to set up netpol sweeper")
+			os.Exit(1)
+		}
+	}
+	if trigger != nil {
+		// only the leader runs the controllers picking up the triggered reconciles, so only it serves the endpoint
+		if err := mgr.Add(manager.RunnableFunc(func(ctx context.Context) error {
+			return serveAdmin(ctx, adminAddr, adminCertFile, adminKeyFile, tlsOpts, adminHandler(
+				controller.NewReconcileHandler(trigger, adminToken),
+				controller.NewInventoryHandler(mgr.GetClient(), adminToken),
+			))
+		})); err != nil {
+			setupLog.Error(err, "unable to set up admin endpoint")
+			os.Exit(1)
+		}
+	}
 	//+kubebuilder:scaffold:builder
 
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
@@ -130,3 +331,129 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+// metricsServerOptions configures the metrics endpoint. In secure mode metrics are served over
+// HTTPS, with requests authenticated and authorized against the Kubernetes API.
+func metricsServerOptions(bindAddress string, secure bool, tlsOpts []func(*tls.Config)) metricsserver.Options {
+	opts := metricsserver.Options{
+		BindAddress: bindAddress,
+		TLSOpts:     tlsOpts,
+	}
+	if secure {
+		opts.SecureServing = true
+		opts.FilterProvider = filters.WithAuthenticationAndAuthorization
+	}
+	return opts
+}
+
+// requireKinds checks that the cluster serves the kinds, so that we fail at startup rather than requeue every
+// reconcile when the CRDs are not installed.
+func requireKinds(mapper meta.RESTMapper, gvks ...schema.GroupVersionKind) error {
+	var missing []string
+	for _, gvk := range gvks {
+		_, err := mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+		if meta.IsNoMatchError(err) {
+			missing = append(missing, gvk.String())
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to look up %s: %w", gvk, err)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("kinds not served by the cluster: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// readAdminToken reads the bearer token of the admin endpoint, which must not be empty.
+func readAdminToken(path string) (string, error) {
+	if path == "" {
+		return "", fmt.Errorf("--admin-token-file is required with --admin-bind-address")
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(content))
+	if token == "" {
+		return "", fmt.Errorf("admin token file %s is empty", path)
+	}
+	return token, nil
+}
+
+// adminHandler routes POST /reconcile/... to the reconcile handler, and GET /inventory to the inventory handler.
+func adminHandler(reconcileHandler, inventoryHandler http.Handler) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/reconcile/", reconcileHandler)
+	mux.Handle("/inventory", inventoryHandler)
+	return mux
+}
+
+// checkAdminAddress refuses to send the bearer token of the admin endpoint over plain HTTP beyond localhost.
+func checkAdminAddress(addr, certFile, keyFile string) error {
+	if (certFile == "") != (keyFile == "") {
+		return fmt.Errorf("--admin-cert-file and --admin-key-file must be set together")
+	}
+	if certFile != "" {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid admin bind address %q: %w", addr, err)
+	}
+	if ip := net.ParseIP(host); host == "localhost" || (ip != nil && ip.IsLoopback()) {
+		return nil
+	}
+	return fmt.Errorf("admin endpoint binds to %s over plain HTTP, set --admin-cert-file or bind to localhost", addr)
+}
+
+// serveAdmin serves the admin endpoint on addr until ctx is done, over HTTPS if there is a certificate.
+func serveAdmin(ctx context.Context, addr, certFile, keyFile string, tlsOpts []func(*tls.Config), handler http.Handler) error {
+	server := &http.Server{Addr: addr, Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		_ = server.Shutdown(context.Background())
+	}()
+	var err error
+	if certFile != "" {
+		server.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+		for _, opt := range tlsOpts {
+			opt(server.TLSConfig)
+		}
+		err = server.ListenAndServeTLS(certFile, keyFile)
+	} else {
+		err = server.ListenAndServe()
+	}
+	if !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// applyLogFlags sets the level and encoder of the zap options from the --log-level and --log-format flags.
+// Empty values leave the options from the --zap flags alone.
+func applyLogFlags(opts *zap.Options, level, format string) error {
+	if level != "" {
+		if verbosity, err := strconv.Atoi(level); err == nil && verbosity >= 0 {
+			// logr verbosity n is logged at zap level -n
+			opts.Level = zapcore.Level(-verbosity)
+		} else {
+			var zapLevel zapcore.Level
+			if err := zapLevel.UnmarshalText([]byte(level)); err != nil {
+				return fmt.Errorf("invalid log level %q: %w", level, err)
+			}
+			opts.Level = zapLevel
+		}
+	}
+	switch format {
+	case "":
+	case "json":
+		zap.JSONEncoder()(opts)
+	case "console":
+		zap.ConsoleEncoder()(opts)
+	default:
+		return fmt.Errorf("invalid log format %q, must be json or console", format)
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/k8s-config-connector/pkg/clients/generated/apis/sql/v1beta1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
+)
+
+func TestSecureMetricsServerStarts(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	if err := listener.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := metricsServerOptions(addr, true, nil)
+	if !opts.SecureServing {
+		t.Fatal("expected secure serving to be enabled")
+	}
+	if opts.FilterProvider == nil {
+		t.Fatal("expected an authn/authz filter provider")
+	}
+	opts.CertDir = t.TempDir()
+
+	server, err := metricsserver.NewServer(opts, &rest.Config{Host: "https://127.0.0.1:1"}, http.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = server.Start(ctx)
+	}()
+
+	httpClient := &http.Client{
+		Timeout: time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, //nolint:gosec // self-signed test cert
+		},
+	}
+
+	var resp *http.Response
+	for i := 0; i < 50; i++ {
+		resp, err = httpClient.Get("https://" + addr + "/metrics")
+		if err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("metrics server did not respond over https: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.TLS == nil {
+		t.Fatal("expected metrics to be served over TLS")
+	}
+}
+
+func TestInsecureMetricsIsDefault(t *testing.T) {
+	opts := metricsServerOptions(":8080", false, nil)
+	if opts.SecureServing {
+		t.Fatal("expected secure serving to be disabled")
+	}
+	if opts.FilterProvider != nil {
+		t.Fatal("expected no filter provider")
+	}
+}
+
+func TestLogLevelGatesVerbosity(t *testing.T) {
+	for _, tc := range []struct {
+		level   string
+		visible bool
+	}{
+		{level: "4", visible: true},
+		{level: "debug", visible: false},
+		{level: "info", visible: false},
+	} {
+		t.Run(tc.level, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			opts := zap.Options{DestWriter: buf}
+			if err := applyLogFlags(&opts, tc.level, "json"); err != nil {
+				t.Fatal(err)
+			}
+			logger := zap.New(zap.UseFlagOptions(&opts))
+
+			logger.V(4).Info("verbose")
+			logger.V(5).Info("too verbose")
+			logger.Info("info")
+
+			lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+			for _, line := range lines {
+				if !json.Valid([]byte(line)) {
+					t.Fatalf("expected json logs, got %q", line)
+				}
+			}
+			if got := strings.Contains(buf.String(), `"verbose"`); got != tc.visible {
+				t.Fatalf("expected V(4) logged to be %t, got %t", tc.visible, got)
+			}
+			if strings.Contains(buf.String(), "too verbose") {
+				t.Fatal("expected V(5) not to be logged")
+			}
+			if !strings.Contains(buf.String(), `"info"`) {
+				t.Fatal("expected info to be logged")
+			}
+		})
+	}
+}
+
+func TestInvalidLogFlags(t *testing.T) {
+	if err := applyLogFlags(&zap.Options{}, "loud", ""); err == nil {
+		t.Fatal("expected an invalid log level to fail")
+	}
+	if err := applyLogFlags(&zap.Options{}, "", "xml"); err == nil {
+		t.Fatal("expected an invalid log format to fail")
+	}
+}
+
+func TestRequireKindsReportsMissingCRDs(t *testing.T) {
+	mapper := meta.NewDefaultRESTMapper(nil)
+	mapper.Add(v1beta1.SQLUserGVK, meta.RESTScopeNamespace)
+
+	if err := requireKinds(mapper, v1beta1.SQLUserGVK); err != nil {
+		t.Fatalf("expected installed kinds to pass, got %v", err)
+	}
+
+	err := requireKinds(mapper, v1beta1.SQLUserGVK, v1beta1.SQLSSLCertGVK, v1beta1.SQLInstanceGVK)
+	if err == nil {
+		t.Fatal("expected missing kinds to fail")
+	}
+	for _, kind := range []string{"SQLSSLCert", "SQLInstance"} {
+		if !strings.Contains(err.Error(), kind) {
+			t.Errorf("expected %q to name the missing kind %s", err, kind)
+		}
+	}
+	if strings.Contains(err.Error(), "SQLUser") {
+		t.Errorf("expected %q not to name the installed kind SQLUser", err)
+	}
+}
+
+func TestAdminEndpointOnlyPlainHTTPOnLocalhost(t *testing.T) {
+	for _, addr := range []string{"localhost:8082", "127.0.0.1:8082", "[::1]:8082"} {
+		if err := checkAdminAddress(addr, "", ""); err != nil {
+			t.Errorf("expected plain HTTP on %s to be allowed, got %v", addr, err)
+		}
+	}
+	for _, addr := range []string{":8082", "0.0.0.0:8082", "10.0.0.1:8082"} {
+		if err := checkAdminAddress(addr, "", ""); err == nil {
+			t.Errorf("expected plain HTTP on %s to be refused", addr)
+		}
+		if err := checkAdminAddress(addr, "tls.crt", "tls.key"); err != nil {
+			t.Errorf("expected HTTPS on %s to be allowed, got %v", addr, err)
+		}
+	}
+	if err := checkAdminAddress(":8082", "tls.crt", ""); err == nil {
+		t.Error("expected a certificate without a key to be refused")
+	}
+}
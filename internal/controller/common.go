@@ -1,10 +1,40 @@
 package controller
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	core_v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/utils/clock"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 )
 
 const (
@@ -15,8 +45,105 @@ const (
 	appKey                     = "app"
 	teamKey                    = "team"
 	sqeletorFqdnId             = "sqeletor.nais.io"
+	secretKindKey              = "sqeletor.nais.io/secret-kind"
+	secretKindCredentials      = "credentials"
+	secretKindCertificate      = "certificate"
+	secretKindCombined         = "combined"
+	// pausedAnnotation stops sqeletor from touching the resources it manages for the annotated resource
+	pausedAnnotation = "sqeletor.nais.io/paused"
+	// ownersAnnotation holds the owners of a resource as JSON owner references, when owner references are disabled
+	ownersAnnotation = "sqeletor.nais.io/owners"
+	// managedKeysAnnotation lists the keys we write to a secret, sorted and comma separated
+	managedKeysAnnotation = "sqeletor.nais.io/managed-keys"
+	// managedLabelsAnnotation records the values an owner writes to the labels it shares with the other owners of a
+	// secret, like app=my-app,team=my-team
+	managedLabelsAnnotation = "sqeletor.nais.io/managed-labels"
+	// sourceGenerationAnnotation records the generation of the resource a secret was last built from, to tell
+	// whether it is stale
+	sourceGenerationAnnotation = "sqeletor.nais.io/source-generation"
+	// secretTypeAnnotation sets the type of the secret, e.g. a Service Binding type, instead of Opaque
+	secretTypeAnnotation = "sqeletor.nais.io/secret-type"
+	// ownerAnnotationNameLength is how much of a long owner name is kept in owner annotations, leaving room for a hash,
+	// the kind and the domain in the prefix
+	ownerAnnotationNameLength = 200
 )
 
+// builtinSecretTypes require keys we don't write, so they can't be used for our secrets
+var builtinSecretTypes = []core_v1.SecretType{
+	core_v1.SecretTypeServiceAccountToken,
+	core_v1.SecretTypeDockercfg,
+	core_v1.SecretTypeDockerConfigJson,
+	core_v1.SecretTypeBasicAuth,
+	core_v1.SecretTypeSSHAuth,
+	core_v1.SecretTypeTLS,
+	core_v1.SecretTypeBootstrapToken,
+}
+
+const (
+	requeueIntervalAnnotation = "sqeletor.nais.io/requeue-interval"
+	defaultRequeueInterval    = time.Minute
+	minRequeueInterval        = 5 * time.Second
+	maxRequeueInterval        = 30 * time.Minute
+)
+
+var lastSuccessfulReconcileMetric = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "sqeletor_last_success_timestamp_seconds",
+	Help: "Unix timestamp of the last successful reconcile, per controller",
+}, []string{"controller"})
+
+var reconcileTotalMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "sqeletor_reconcile_total",
+	Help: "Number of reconciles, per controller and result, and team and app if resource metric labels are enabled",
+}, []string{"controller", "result", "team", "app"})
+
+var reconcileDurationMetric = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "sqeletor_reconcile_duration_seconds",
+	Help:    "Duration of reconciles, per controller, and team and app if resource metric labels are enabled",
+	Buckets: prometheus.DefBuckets,
+}, []string{"controller", "team", "app"})
+
+var requeueReasonMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "sqeletor_requeues_total",
+	Help: "Number of requeues after temporary failures, per controller and reason",
+}, []string{"controller", "reason"})
+
+// results of a reconcile, as reported by reconcileTotalMetric
+const (
+	reconcileResultSuccess = "success"
+	reconcileResultRequeue = "requeue"
+	reconcileResultError   = "error"
+)
+
+func init() {
+	metrics.Registry.MustRegister(lastSuccessfulReconcileMetric, reconcileTotalMetric, reconcileDurationMetric, requeueReasonMetric)
+}
+
+// resourceLabels are the team and app of a reconciled resource, as labels on the reconcile metrics.
+type resourceLabels struct {
+	team string
+	app  string
+}
+
+// metricResourceLabels returns the team and app labels of the reconciled resource, if enabled. Resources that are
+// gone are left empty by the reconcile, and have no labels.
+func metricResourceLabels(enabled bool, obj client.Object) resourceLabels {
+	if !enabled {
+		return resourceLabels{}
+	}
+	return resourceLabels{team: obj.GetLabels()[teamKey], app: obj.GetLabels()[appKey]}
+}
+
+// observeReconcile records the result and duration of a reconcile of the given controller that started at start.
+func observeReconcile(controller, result string, start time.Time, resource resourceLabels) {
+	reconcileTotalMetric.WithLabelValues(controller, result, resource.team, resource.app).Inc()
+	reconcileDurationMetric.WithLabelValues(controller, resource.team, resource.app).Observe(time.Since(start).Seconds())
+}
+
+// observeRequeue records a requeue of the given controller after the temporary failure err.
+func observeRequeue(controller string, err error) {
+	requeueReasonMetric.WithLabelValues(controller, string(failureReasonOf(err))).Inc()
+}
+
 var (
 	errTemporaryFailure = errors.New("temporary failure")
 	errPermanentFailure = errors.New("permanent failure")
@@ -24,35 +151,797 @@ var (
 	errNoOwner          = fmt.Errorf("no owner: %w", errPermanentFailure)
 	errMultipleOwners   = fmt.Errorf("multiple owners: %w", errPermanentFailure)
 	errOwnedByOther     = fmt.Errorf("owned by other: %w", errPermanentFailure)
+	errUnexpectedKind   = fmt.Errorf("unexpected api version: %w", errPermanentFailure)
+)
+
+// failureReason categorizes temporary failures, for alerting on what reconciles are waiting for.
+type failureReason string
+
+const (
+	reasonAPIError                 failureReason = "api_error"
+	reasonWaitingForInstanceIP     failureReason = "waiting_for_instance_ip"
+	reasonWaitingForConnectionName failureReason = "waiting_for_connection_name"
+	reasonWaitingForCertStatus     failureReason = "waiting_for_cert_status"
+	reasonWaitingForPassword       failureReason = "waiting_for_password"
+	reasonCRDNotInstalled          failureReason = "crd_not_installed"
 )
 
+// temporaryFailure is a failure expected to resolve itself, with the reason we're waiting.
+type temporaryFailure struct {
+	reason failureReason
+	err    error
+}
+
+func (f *temporaryFailure) Error() string {
+	return fmt.Sprintf("%s: %s", errTemporaryFailure, f.err)
+}
+
+func (f *temporaryFailure) Unwrap() []error {
+	return []error{errTemporaryFailure, f.err}
+}
+
+// temporaryFailureError wraps err as a temporary failure, mostly failing API calls.
+// An err that already is a temporary failure keeps its reason.
 func temporaryFailureError(err error) error {
-	return fmt.Errorf("%w: %w", errTemporaryFailure, err)
+	var existing *temporaryFailure
+	if errors.As(err, &existing) {
+		return err
+	}
+	// the kind is not served, until the CRD is installed again
+	if meta.IsNoMatchError(err) {
+		return temporaryFailureErrorFor(reasonCRDNotInstalled, err)
+	}
+	return temporaryFailureErrorFor(reasonAPIError, err)
+}
+
+// temporaryFailureErrorFor wraps err as a temporary failure for the given reason.
+func temporaryFailureErrorFor(reason failureReason, err error) error {
+	return &temporaryFailure{reason: reason, err: err}
+}
+
+// failureReasonOf returns the reason of a temporary failure, or an api error if it has none.
+func failureReasonOf(err error) failureReason {
+	var failure *temporaryFailure
+	if errors.As(err, &failure) {
+		return failure.reason
+	}
+	return reasonAPIError
 }
 
 func permanentFailureError(err error) error {
 	return fmt.Errorf("%w: %w", errPermanentFailure, err)
 }
 
-func validateOwnership(ownerReference meta_v1.OwnerReference, meta meta_v1.Object) error {
+// sharedSecretOwnerKinds are the kinds that may co-own a single secret, each contributing their own keys.
+var sharedSecretOwnerKinds = []string{"SQLUser", "SQLSSLCert"}
+
+// sharedSecretCoOwners returns the owner references that may co-own a shared secret with ownerReference:
+// any number of SQLUsers, each writing keys with its own env var prefix, and any one SQLSSLCert.
+func sharedSecretCoOwners(ownerReference meta_v1.OwnerReference, meta meta_v1.Object) []meta_v1.OwnerReference {
+	if !slices.Contains(sharedSecretOwnerKinds, ownerReference.Kind) {
+		return nil
+	}
+	var coOwners []meta_v1.OwnerReference
+	if ownerReference.Kind != "SQLSSLCert" {
+		coOwners = append(coOwners, meta_v1.OwnerReference{APIVersion: ownerReference.APIVersion, Kind: "SQLSSLCert"})
+	}
+	for _, existing := range ownerReferencesOf(meta) {
+		if existing.APIVersion == ownerReference.APIVersion && existing.Kind == "SQLUser" && !(ownerReference.Kind == "SQLUser" && existing.Name == ownerReference.Name) {
+			coOwners = append(coOwners, existing)
+		}
+	}
+	return coOwners
+}
+
+// validateOwnership checks that we manage the resource, and that every owner is either ownerReference or one of coOwners.
+// A co-owner without a name accepts any owner of its kind, but each co-owner may only match one owner.
+func validateOwnership(ownerReference meta_v1.OwnerReference, meta meta_v1.Object, coOwners ...meta_v1.OwnerReference) error {
 	// if we don't manage this resource, error out
 	if meta.GetLabels()[managedByKey] != sqeletorFqdnId {
 		return fmt.Errorf("resource %s in namespace %s is not managed by us: %w", meta.GetName(), meta.GetNamespace(), errNotManaged)
 	}
 
-	ownerReferences := meta.GetOwnerReferences()
+	ownerReferences := ownerReferencesOf(meta)
 	if len(ownerReferences) == 0 {
 		return fmt.Errorf("resource %s in namespace %s does not have any owner reference: %w", meta.GetName(), meta.GetNamespace(), errNoOwner)
 	}
-	if len(ownerReferences) > 1 {
+	acceptable := append([]meta_v1.OwnerReference{ownerReference}, coOwners...)
+	if len(ownerReferences) > len(acceptable) {
 		return fmt.Errorf("resource %s in namespace %s has multiple owner references: %w", meta.GetName(), meta.GetNamespace(), errMultipleOwners)
 	}
 
-	if ownerReferences[0].APIVersion != ownerReference.APIVersion ||
-		ownerReferences[0].Kind != ownerReference.Kind ||
-		ownerReferences[0].Name != ownerReference.Name {
-		return fmt.Errorf("resource %s in namespace %s has different owner reference: %w", meta.GetName(), meta.GetNamespace(), errOwnedByOther)
+	matched := make([]bool, len(acceptable))
+	for _, existing := range ownerReferences {
+		i := slices.IndexFunc(acceptable, func(ref meta_v1.OwnerReference) bool {
+			return ref.APIVersion == existing.APIVersion && ref.Kind == existing.Kind && (ref.Name == "" || ref.Name == existing.Name)
+		})
+		if i < 0 {
+			return fmt.Errorf("resource %s in namespace %s has different owner reference: %w", meta.GetName(), meta.GetNamespace(), errOwnedByOther)
+		}
+		if matched[i] {
+			return fmt.Errorf("resource %s in namespace %s has multiple owner references: %w", meta.GetName(), meta.GetNamespace(), errMultipleOwners)
+		}
+		matched[i] = true
 	}
 
 	return nil
 }
+
+// ownerReferenceFor returns a controller owner reference to owner, blocking its deletion until dependents are gone.
+// The kind is looked up in the scheme, as objects from the cache don't have their TypeMeta set.
+func ownerReferenceFor(scheme *runtime.Scheme, owner client.Object) (meta_v1.OwnerReference, error) {
+	gvk, err := groupVersionKindOf(scheme, owner)
+	if err != nil {
+		return meta_v1.OwnerReference{}, err
+	}
+	return meta_v1.OwnerReference{
+		APIVersion:         gvk.GroupVersion().String(),
+		Kind:               gvk.Kind,
+		Name:               owner.GetName(),
+		UID:                owner.GetUID(),
+		Controller:         ptr.To(true),
+		BlockOwnerDeletion: ptr.To(true),
+	}, nil
+}
+
+// groupVersionKindOf returns the kind the scheme has registered for obj. If obj has its TypeMeta set, it must be
+// one of the registered kinds, so that we never reconcile an object of an api version we don't know.
+func groupVersionKindOf(scheme *runtime.Scheme, obj client.Object) (schema.GroupVersionKind, error) {
+	gvks, _, err := scheme.ObjectKinds(obj)
+	if err != nil {
+		return schema.GroupVersionKind{}, permanentFailureError(fmt.Errorf("failed to look up kind of %s: %w", obj.GetName(), err))
+	}
+	gvk := obj.GetObjectKind().GroupVersionKind()
+	if gvk.Empty() {
+		if len(gvks) != 1 {
+			return schema.GroupVersionKind{}, permanentFailureError(fmt.Errorf("ambiguous kind of %s: %v", obj.GetName(), gvks))
+		}
+		return gvks[0], nil
+	}
+	if !slices.Contains(gvks, gvk) {
+		return schema.GroupVersionKind{}, fmt.Errorf("%s is a %s, expected one of %v: %w", obj.GetName(), gvk, gvks, errUnexpectedKind)
+	}
+	return gvk, nil
+}
+
+// ensureOwnerReference adds the owner reference, or replaces an existing owner reference of the same kind
+// so that references written before the controller flag was set are upgraded.
+// Only one owner may be the controller, so a co-owner added after another controller is not marked as one.
+// Must only be called after validateOwnership has succeeded.
+func ensureOwnerReference(ownerReference meta_v1.OwnerReference, meta meta_v1.Object) {
+	meta.SetOwnerReferences(upsertOwnerReference(meta.GetOwnerReferences(), ownerReference))
+}
+
+// setOwner records the owner either as an owner reference or, if annotated is set, in the owners annotation
+// so that garbage collection does not get involved. The owner is removed from the other, to support switching.
+// Must only be called after validateOwnership has succeeded.
+func setOwner(ownerReference meta_v1.OwnerReference, meta meta_v1.Object, annotated bool) {
+	if !annotated {
+		ensureOwnerReference(ownerReference, meta)
+		setAnnotatedOwnerReferences(meta, removeOwnerReference(annotatedOwnerReferences(meta), ownerReference))
+		return
+	}
+	meta.SetOwnerReferences(removeOwnerReference(meta.GetOwnerReferences(), ownerReference))
+	if len(meta.GetOwnerReferences()) == 0 {
+		meta.SetOwnerReferences(nil)
+	}
+	setAnnotatedOwnerReferences(meta, upsertOwnerReference(annotatedOwnerReferences(meta), ownerReference))
+}
+
+// upsertOwnerReference adds the owner reference to the list, replacing an existing reference of the same kind and name.
+func upsertOwnerReference(ownerReferences []meta_v1.OwnerReference, ownerReference meta_v1.OwnerReference) []meta_v1.OwnerReference {
+	index := -1
+	otherController := false
+	for i, existing := range ownerReferences {
+		if existing.APIVersion == ownerReference.APIVersion && existing.Kind == ownerReference.Kind && existing.Name == ownerReference.Name {
+			index = i
+		} else if ptr.Deref(existing.Controller, false) {
+			otherController = true
+		}
+	}
+	if otherController {
+		ownerReference.Controller = ptr.To(false)
+	}
+	if index >= 0 {
+		ownerReferences[index] = ownerReference
+	} else {
+		ownerReferences = append(ownerReferences, ownerReference)
+	}
+	return ownerReferences
+}
+
+// removeOwnerReference removes references of the same kind and name as the owner reference from the list.
+func removeOwnerReference(ownerReferences []meta_v1.OwnerReference, ownerReference meta_v1.OwnerReference) []meta_v1.OwnerReference {
+	return slices.DeleteFunc(ownerReferences, func(existing meta_v1.OwnerReference) bool {
+		return existing.APIVersion == ownerReference.APIVersion && existing.Kind == ownerReference.Kind && existing.Name == ownerReference.Name
+	})
+}
+
+// ownerReferencesOf returns both the owner references and the annotated owners of the resource.
+func ownerReferencesOf(meta meta_v1.Object) []meta_v1.OwnerReference {
+	return append(slices.Clone(meta.GetOwnerReferences()), annotatedOwnerReferences(meta)...)
+}
+
+// annotatedOwnerReferences returns the owners in the owners annotation. An unparsable annotation is treated as
+// having no owners, which makes validateOwnership refuse to touch the resource.
+func annotatedOwnerReferences(meta meta_v1.Object) []meta_v1.OwnerReference {
+	value, ok := meta.GetAnnotations()[ownersAnnotation]
+	if !ok {
+		return nil
+	}
+	var ownerReferences []meta_v1.OwnerReference
+	if err := json.Unmarshal([]byte(value), &ownerReferences); err != nil {
+		return nil
+	}
+	return ownerReferences
+}
+
+func setAnnotatedOwnerReferences(meta meta_v1.Object, ownerReferences []meta_v1.OwnerReference) {
+	annotations := meta.GetAnnotations()
+	if len(ownerReferences) == 0 {
+		if _, ok := annotations[ownersAnnotation]; ok {
+			delete(annotations, ownersAnnotation)
+			meta.SetAnnotations(annotations)
+		}
+		return
+	}
+	// owner references always marshal
+	value, _ := json.Marshal(ownerReferences)
+	if annotations == nil {
+		annotations = make(map[string]string)
+	}
+	annotations[ownersAnnotation] = string(value)
+	meta.SetAnnotations(annotations)
+}
+
+// resolveTeam returns the team label of the resource, falling back to namespaceLabel on its namespace.
+// Returns an empty string if neither is set.
+func resolveTeam(ctx context.Context, c client.Client, obj client.Object, namespaceLabel string) (string, error) {
+	if team := obj.GetLabels()[teamKey]; team != "" {
+		return team, nil
+	}
+	if namespaceLabel == "" {
+		namespaceLabel = teamKey
+	}
+	namespace := &core_v1.Namespace{}
+	if err := c.Get(ctx, types.NamespacedName{Name: obj.GetNamespace()}, namespace); err != nil {
+		if apierrors.IsNotFound(err) {
+			return "", nil
+		}
+		return "", temporaryFailureError(fmt.Errorf("failed to get namespace %s: %w", obj.GetNamespace(), err))
+	}
+	return namespace.Labels[namespaceLabel], nil
+}
+
+// setManagedLabels sets the labels sqeletor manages, returning the sorted keys whose existing values differed.
+func setManagedLabels(meta meta_v1.Object, expected map[string]string) []string {
+	labels := meta.GetLabels()
+	if labels == nil {
+		labels = make(map[string]string)
+	}
+	drifted := []string{}
+	for key, value := range expected {
+		if labels[key] != value {
+			drifted = append(drifted, key)
+		}
+		labels[key] = value
+	}
+	meta.SetLabels(labels)
+	slices.Sort(drifted)
+	return drifted
+}
+
+// setSecretLabels sets the labels sqeletor manages on a secret, returning the sorted keys whose existing values were
+// changed externally, like setManagedLabels. The secret kind follows the kinds of the owners and is left out. Owners
+// sharing the secret may disagree on the shared labels, like the app, in which case a value written by another owner
+// is kept rather than reset and reported.
+func setSecretLabels(secret *core_v1.Secret, ownerReference meta_v1.OwnerReference, kind string, shared map[string]string) []string {
+	coOwned := map[string][]string{}
+	owners := ownerReferencesOf(secret)
+	// until the first owner of a secret now shared has reconciled, what it wrote is recorded unqualified
+	recorded := []string{}
+	if len(owners) > 1 {
+		recorded = append(recorded, secret.Annotations[managedLabelsAnnotation])
+	}
+	for _, existing := range owners {
+		if existing.Kind != ownerReference.Kind || existing.Name != ownerReference.Name {
+			recorded = append(recorded, secret.Annotations[ownerAnnotation(existing, managedLabelsAnnotation)])
+		}
+	}
+	for _, annotation := range recorded {
+		for key, value := range parseManagedLabels(annotation) {
+			coOwned[key] = append(coOwned[key], value)
+		}
+	}
+	expected := map[string]string{typeKey: sqeletorFqdnId}
+	for key, value := range shared {
+		if current, ok := secret.Labels[key]; ok && current != value && slices.Contains(coOwned[key], current) {
+			continue
+		}
+		expected[key] = value
+	}
+	drifted := setManagedLabels(secret, expected)
+	secret.Labels[secretKindKey] = mergeSecretKind(secret.Labels[secretKindKey], kind)
+	setOwnerAnnotation(secret, ownerReference, managedLabelsAnnotation, labels.Set(shared).String())
+	return drifted
+}
+
+// parseManagedLabels parses the labels recorded in managedLabelsAnnotation.
+func parseManagedLabels(value string) map[string]string {
+	parsed := map[string]string{}
+	for _, label := range strings.Split(value, ",") {
+		if key, value, ok := strings.Cut(label, "="); ok {
+			parsed[key] = value
+		}
+	}
+	return parsed
+}
+
+// reportLabelDrift logs and emits a warning on the owner about managed labels that were changed externally and have been reset.
+func reportLabelDrift(ctx context.Context, recorder record.EventRecorder, owner runtime.Object, meta meta_v1.Object, drifted []string) {
+	log.FromContext(ctx).Info("Reset drifted managed labels", "resource", meta.GetName(), "labels", drifted)
+	recorder.Eventf(owner, core_v1.EventTypeWarning, "LabelDrift", "Managed labels %s on %s were changed externally and have been reset", strings.Join(drifted, ", "), meta.GetName())
+}
+
+// mergeSecretKind returns the secret kind label value to use when a controller of the given kind
+// writes to a secret that may already carry keys of another kind.
+func mergeSecretKind(existing, kind string) string {
+	if existing == "" || existing == kind {
+		return kind
+	}
+	return secretKindCombined
+}
+
+// ownerAnnotation qualifies the annotation with the owner, for annotations of secrets shared by several owners,
+// like app-user.sqluser.sqeletor.nais.io/managed-keys. Owner names too long for the 253 characters allowed in the
+// prefix are shortened, with a hash of the full name keeping them apart.
+func ownerAnnotation(ownerReference meta_v1.OwnerReference, annotation string) string {
+	annotation = strings.ToLower(ownerReference.Kind) + "." + annotation
+	name := strings.ToLower(ownerReference.Name)
+	if len(validation.IsQualifiedName(name+"."+annotation)) == 0 {
+		return name + "." + annotation
+	}
+	h := sha256.Sum256([]byte(ownerReference.Name))
+	return strings.Trim(name[:min(len(name), ownerAnnotationNameLength)], ".-") + "-" + hex.EncodeToString(h[:])[:8] + "." + annotation
+}
+
+// ownerManagedKeysAnnotation is the annotation recording the keys written by the owner.
+func ownerManagedKeysAnnotation(ownerReference meta_v1.OwnerReference) string {
+	return ownerAnnotation(ownerReference, managedKeysAnnotation)
+}
+
+// setSourceGeneration records the generation of the owner the secret was built from.
+func setSourceGeneration(secret *core_v1.Secret, ownerReference meta_v1.OwnerReference, generation int64) {
+	setOwnerAnnotation(secret, ownerReference, sourceGenerationAnnotation, strconv.FormatInt(generation, 10))
+}
+
+// setOwnerAnnotation sets an annotation about what the owner wrote to the secret. Secrets with several owners
+// record it per owner instead.
+func setOwnerAnnotation(secret *core_v1.Secret, ownerReference meta_v1.OwnerReference, annotation, value string) {
+	writeOwnerAnnotation(secret, ownerReference, annotation, value, len(ownerReferencesOf(secret)) > 1)
+}
+
+// setKindOwnerAnnotation is setOwnerAnnotation for annotations only written by owners of one kind, which are only
+// recorded per owner when several owners of the kind share the secret.
+func setKindOwnerAnnotation(secret *core_v1.Secret, ownerReference meta_v1.OwnerReference, annotation, value string) {
+	ofKind := 0
+	for _, existing := range ownerReferencesOf(secret) {
+		if existing.Kind == ownerReference.Kind {
+			ofKind++
+		}
+	}
+	writeOwnerAnnotation(secret, ownerReference, annotation, value, ofKind > 1)
+}
+
+func writeOwnerAnnotation(secret *core_v1.Secret, ownerReference meta_v1.OwnerReference, annotation, value string, perOwner bool) {
+	if perOwner {
+		delete(secret.Annotations, annotation)
+		secret.Annotations[ownerAnnotation(ownerReference, annotation)] = value
+		return
+	}
+	delete(secret.Annotations, ownerAnnotation(ownerReference, annotation))
+	secret.Annotations[annotation] = value
+}
+
+// kindOwnerAnnotation returns the annotation the owner recorded with setKindOwnerAnnotation. Until the owner has
+// recorded it per owner, an unqualified one may have been recorded by another owner before the secret was shared.
+func kindOwnerAnnotation(secret *core_v1.Secret, ownerReference meta_v1.OwnerReference, annotation string) string {
+	if value, ok := secret.Annotations[ownerAnnotation(ownerReference, annotation)]; ok {
+		return value
+	}
+	return secret.Annotations[annotation]
+}
+
+// deleteKindOwnerAnnotation removes the annotation the owner recorded with setKindOwnerAnnotation. An unqualified one
+// is removed as well, as it is either the owner's or left over from before the secret was shared.
+func deleteKindOwnerAnnotation(secret *core_v1.Secret, ownerReference meta_v1.OwnerReference, annotation string) {
+	delete(secret.Annotations, ownerAnnotation(ownerReference, annotation))
+	delete(secret.Annotations, annotation)
+}
+
+// kindOwnerAnnotations returns the values of the annotation recorded with setKindOwnerAnnotation by the owners of the
+// kind.
+func kindOwnerAnnotations(secret *core_v1.Secret, kind, annotation string) []string {
+	var values []string
+	if value, ok := secret.Annotations[annotation]; ok {
+		values = append(values, value)
+	}
+	for _, existing := range ownerReferencesOf(secret) {
+		if value, ok := secret.Annotations[ownerAnnotation(existing, annotation)]; ok && existing.Kind == kind {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// secretTypeOf returns the type of secret the owner asks for with the secret type annotation, Opaque by default.
+func secretTypeOf(owner meta_v1.Object) (core_v1.SecretType, error) {
+	value, ok := owner.GetAnnotations()[secretTypeAnnotation]
+	if !ok {
+		return core_v1.SecretTypeOpaque, nil
+	}
+	secretType := core_v1.SecretType(value)
+	if slices.Contains(builtinSecretTypes, secretType) {
+		return "", permanentFailureError(fmt.Errorf("unsupported %s annotation %q, built in types require keys that are not written", secretTypeAnnotation, value))
+	}
+	if errs := validation.IsQualifiedName(value); len(errs) > 0 {
+		return "", permanentFailureError(fmt.Errorf("invalid %s annotation %q: %s", secretTypeAnnotation, value, strings.Join(errs, ", ")))
+	}
+	return secretType, nil
+}
+
+// ensureSecretType recreates the secret if it exists with another type, as the type of a secret is immutable. The
+// data and metadata are carried over, so that e.g. a generated password survives. Secrets not owned by the owner are
+// left alone, for the ownership validation to reject. Owners sharing a secret must agree on its type, the secret is
+// not recreated while another owner asks for a different one.
+func ensureSecretType(ctx context.Context, c client.Client, recorder record.EventRecorder, owner client.Object, key types.NamespacedName, ownerReference meta_v1.OwnerReference, secretType core_v1.SecretType) error {
+	secret := &core_v1.Secret{}
+	if err := c.Get(ctx, key, secret); err != nil {
+		if apierrors.IsNotFound(err) {
+			return restoreStashedSecret(ctx, c, key)
+		}
+		return temporaryFailureError(fmt.Errorf("failed to get secret: %w", err))
+	}
+	currentType := secret.Type
+	if currentType == "" {
+		currentType = core_v1.SecretTypeOpaque
+	}
+	owned := slices.ContainsFunc(ownerReferencesOf(secret), func(existing meta_v1.OwnerReference) bool {
+		return existing.Kind == ownerReference.Kind && existing.Name == ownerReference.Name
+	})
+	if currentType == secretType || secret.Labels[managedByKey] != sqeletorFqdnId || !owned {
+		return nil
+	}
+
+	for _, otherReference := range ownerReferencesOf(secret) {
+		if otherReference.Kind == ownerReference.Kind && otherReference.Name == ownerReference.Name {
+			continue
+		}
+		otherType, err := ownerSecretType(ctx, c, secret.Namespace, otherReference)
+		if err != nil {
+			return err
+		}
+		if otherType != "" && otherType != secretType {
+			recorder.Eventf(owner, core_v1.EventTypeWarning, "SecretTypeConflict", "Secret %s is shared with %s %s, which asks for type %s instead of %s", key.Name, otherReference.Kind, otherReference.Name, otherType, secretType)
+			return permanentFailureError(fmt.Errorf("owners of secret %s ask for types %s and %s", key.Name, secretType, otherType))
+		}
+	}
+
+	log.FromContext(ctx).Info("Recreating secret to change its type", "secret", key.Name, "from", currentType, "to", secretType)
+	// a copy is kept until the secret is recreated, for the next reconcile to restore it from if we fail in between
+	stash := &core_v1.Secret{
+		ObjectMeta: meta_v1.ObjectMeta{
+			Name:            secretTypeStashName(secret.Name),
+			Namespace:       secret.Namespace,
+			Labels:          secret.Labels,
+			Annotations:     secret.Annotations,
+			OwnerReferences: secret.OwnerReferences,
+		},
+		Type: secretType,
+		Data: secret.Data,
+	}
+	// a copy left from an earlier attempt is stale, as the secret still exists
+	if err := c.Delete(ctx, &core_v1.Secret{ObjectMeta: meta_v1.ObjectMeta{Name: stash.Name, Namespace: stash.Namespace}}); client.IgnoreNotFound(err) != nil {
+		return temporaryFailureError(fmt.Errorf("failed to delete stale copy of secret: %w", err))
+	}
+	if err := c.Create(ctx, stash); err != nil {
+		return temporaryFailureError(fmt.Errorf("failed to copy secret before changing its type: %w", err))
+	}
+	// the preconditions make sure we don't delete changes made since we read the secret
+	if err := c.Delete(ctx, secret, client.Preconditions{UID: &secret.UID, ResourceVersion: &secret.ResourceVersion}); err != nil {
+		return temporaryFailureError(fmt.Errorf("failed to delete secret to change its type: %w", err))
+	}
+	return recreateFromStash(ctx, c, key, stash)
+}
+
+// ownerSecretType returns the secret type the owner asks for, or an empty string if the owner is gone or of a kind
+// we don't know.
+func ownerSecretType(ctx context.Context, c client.Client, namespace string, ownerReference meta_v1.OwnerReference) (core_v1.SecretType, error) {
+	gv, err := schema.ParseGroupVersion(ownerReference.APIVersion)
+	if err != nil {
+		return "", nil
+	}
+	obj, err := c.Scheme().New(gv.WithKind(ownerReference.Kind))
+	if err != nil {
+		return "", nil
+	}
+	owner, ok := obj.(client.Object)
+	if !ok {
+		return "", nil
+	}
+	if err := c.Get(ctx, types.NamespacedName{Namespace: namespace, Name: ownerReference.Name}, owner); err != nil {
+		if apierrors.IsNotFound(err) {
+			return "", nil
+		}
+		return "", temporaryFailureError(fmt.Errorf("failed to get owner %s of secret: %w", ownerReference.Name, err))
+	}
+	secretType, err := secretTypeOf(owner)
+	if err != nil {
+		// the owner is refused the secret until it asks for a valid type
+		return "", nil
+	}
+	return secretType, nil
+}
+
+// secretTypeStashName is the name of the copy of a secret kept while it is recreated with another type.
+func secretTypeStashName(name string) string {
+	const suffix = ".type-change"
+	return name[:min(len(name), validation.DNS1123SubdomainMaxLength-len(suffix))] + suffix
+}
+
+// restoreStashedSecret recreates a missing secret from the copy kept while changing its type, if there is one.
+func restoreStashedSecret(ctx context.Context, c client.Client, key types.NamespacedName) error {
+	stash := &core_v1.Secret{}
+	if err := c.Get(ctx, types.NamespacedName{Namespace: key.Namespace, Name: secretTypeStashName(key.Name)}, stash); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		return temporaryFailureError(fmt.Errorf("failed to get copy of secret: %w", err))
+	}
+	log.FromContext(ctx).Info("Restoring secret from the copy kept while changing its type", "secret", key.Name)
+	return recreateFromStash(ctx, c, key, stash)
+}
+
+// recreateFromStash creates the secret from its copy, and then deletes the copy.
+func recreateFromStash(ctx context.Context, c client.Client, key types.NamespacedName, stash *core_v1.Secret) error {
+	recreated := &core_v1.Secret{
+		ObjectMeta: meta_v1.ObjectMeta{
+			Name:            key.Name,
+			Namespace:       key.Namespace,
+			Labels:          stash.Labels,
+			Annotations:     stash.Annotations,
+			OwnerReferences: stash.OwnerReferences,
+		},
+		Type: stash.Type,
+		Data: stash.Data,
+	}
+	if err := c.Create(ctx, recreated); err != nil {
+		return temporaryFailureError(fmt.Errorf("failed to recreate secret with type %s: %w", stash.Type, err))
+	}
+	if err := c.Delete(ctx, stash); client.IgnoreNotFound(err) != nil {
+		return temporaryFailureError(fmt.Errorf("failed to delete copy of secret: %w", err))
+	}
+	return nil
+}
+
+// kindManagedKeysAnnotation is where the keys written by owners of a kind were recorded before there could be
+// more than one owner of a kind. It is only read to find the keys an owner wrote before upgrading.
+func kindManagedKeysAnnotation(kind string) string {
+	return strings.ToLower(kind) + "." + managedKeysAnnotation
+}
+
+// setManagedKeys records keys as the keys written by the owner, and removes the keys it wrote before but no longer
+// writes. Keys written by others sharing the secret, be it a co-owner or an app, are left alone.
+// The managed keys annotation lists the keys of all owners.
+func setManagedKeys(secret *core_v1.Secret, ownerReference meta_v1.OwnerReference, keys []string) {
+	if secret.Annotations == nil {
+		secret.Annotations = make(map[string]string)
+	}
+	annotation := ownerManagedKeysAnnotation(ownerReference)
+	previous, ok := secret.Annotations[annotation]
+	if !ok {
+		previous = secret.Annotations[kindManagedKeysAnnotation(ownerReference.Kind)]
+	}
+	for _, key := range splitManagedKeys(previous) {
+		if !slices.Contains(keys, key) {
+			delete(secret.Data, key)
+			delete(secret.StringData, key)
+		}
+	}
+	delete(secret.Annotations, kindManagedKeysAnnotation(ownerReference.Kind))
+	setManagedKeysAnnotation(secret.Annotations, annotation, keys)
+
+	var all []string
+	for name, value := range secret.Annotations {
+		if strings.HasSuffix(name, "."+managedKeysAnnotation) {
+			all = append(all, splitManagedKeys(value)...)
+		}
+	}
+	setManagedKeysAnnotation(secret.Annotations, managedKeysAnnotation, all)
+}
+
+// validateSharedKeys checks that none of keys are written by another owner of the secret. The keys of other owners
+// of the same kind must be recorded, as they could otherwise collide with keys, so their secrets are left alone.
+func validateSharedKeys(secret *core_v1.Secret, ownerReference meta_v1.OwnerReference, keys []string) error {
+	for _, existing := range ownerReferencesOf(secret) {
+		if existing.Kind != ownerReference.Kind || existing.Name == ownerReference.Name {
+			continue
+		}
+		if _, ok := secret.Annotations[ownerManagedKeysAnnotation(existing)]; !ok {
+			return fmt.Errorf("resource %s in namespace %s is owned by %s %s without a record of its keys: %w", secret.Name, secret.Namespace, existing.Kind, existing.Name, errOwnedByOther)
+		}
+	}
+
+	var conflicts []string
+	for _, key := range otherOwnersKeys(secret, ownerReference) {
+		if slices.Contains(keys, key) {
+			conflicts = append(conflicts, key)
+		}
+	}
+	if len(conflicts) == 0 {
+		return nil
+	}
+	slices.Sort(conflicts)
+	return permanentFailureError(fmt.Errorf("keys %s in secret %s are already written by another owner", strings.Join(conflicts, ", "), secret.Name))
+}
+
+// otherOwnersKeys returns the keys recorded as written by the other owners of the secret.
+func otherOwnersKeys(secret *core_v1.Secret, ownerReference meta_v1.OwnerReference) []string {
+	own := []string{ownerManagedKeysAnnotation(ownerReference), kindManagedKeysAnnotation(ownerReference.Kind)}
+	var keys []string
+	for name, value := range secret.Annotations {
+		if strings.HasSuffix(name, "."+managedKeysAnnotation) && !slices.Contains(own, name) {
+			keys = append(keys, splitManagedKeys(value)...)
+		}
+	}
+	return keys
+}
+
+func splitManagedKeys(value string) []string {
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
+
+// setManagedKeysAnnotation sets the annotation to the sorted, comma separated keys, or removes it if there are none.
+func setManagedKeysAnnotation(annotations map[string]string, annotation string, keys []string) {
+	keys = slices.Clone(keys)
+	slices.Sort(keys)
+	keys = slices.Compact(keys)
+	if len(keys) == 0 {
+		delete(annotations, annotation)
+		return
+	}
+	annotations[annotation] = strings.Join(keys, ",")
+}
+
+// createOrUpdate wraps controllerutil.CreateOrUpdate, retrying with a short backoff on conflicts.
+// This lets us resolve races with other writers within the same reconcile instead of requeueing.
+// A create racing with another create fails with AlreadyExists, which is retried as an update of the winner.
+func createOrUpdate(ctx context.Context, c client.Client, obj client.Object, f controllerutil.MutateFn) (controllerutil.OperationResult, error) {
+	var op controllerutil.OperationResult
+	initial := obj.DeepCopyObject()
+	attempt := 0
+	err := retry.OnError(retry.DefaultBackoff, isCreateOrUpdateRace, func() error {
+		if attempt > 0 {
+			// start over from the initial object, as getting into the object mutated by the previous attempt
+			// would keep fields the mutate function set, like our managed-by label on someone else's resource
+			reflect.ValueOf(obj).Elem().Set(reflect.ValueOf(initial.DeepCopyObject()).Elem())
+		}
+		attempt++
+		var err error
+		op, err = controllerutil.CreateOrUpdate(ctx, c, obj, f)
+		return err
+	})
+	return op, err
+}
+
+func isCreateOrUpdateRace(err error) bool {
+	return apierrors.IsConflict(err) || apierrors.IsAlreadyExists(err)
+}
+
+// isTransientAPIError reports whether the request may succeed if tried again shortly.
+func isTransientAPIError(err error) bool {
+	return apierrors.IsTimeout(err) || apierrors.IsServerTimeout(err) || apierrors.IsTooManyRequests(err) ||
+		apierrors.IsServiceUnavailable(err) || apierrors.IsInternalError(err) || apierrors.IsUnexpectedServerError(err)
+}
+
+// clockNow returns the current time of c, or of the real clock if c is nil.
+func clockNow(c clock.PassiveClock) time.Time {
+	if c == nil {
+		return time.Now()
+	}
+	return c.Now()
+}
+
+// boolAnnotation returns the boolean value of the annotation, or def if it is not set or not a valid boolean.
+func boolAnnotation(meta meta_v1.Object, key string, def bool) bool {
+	value, ok := meta.GetAnnotations()[key]
+	if !ok {
+		return def
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return def
+	}
+	return b
+}
+
+// labelSelectorPredicate filters out objects not matching the selector. A nil selector matches everything.
+func labelSelectorPredicate(selector labels.Selector) predicate.Predicate {
+	return predicate.NewPredicateFuncs(func(obj client.Object) bool {
+		return selectorMatches(selector, obj)
+	})
+}
+
+// selectorMatches reports whether the labels of obj match the selector, where no selector matches everything.
+func selectorMatches(selector labels.Selector, obj meta_v1.Object) bool {
+	return selector == nil || selector.Matches(labels.Set(obj.GetLabels()))
+}
+
+// secretDataChangedPredicate only passes updates changing the data of a secret, so that our own updates of
+// annotations, like the last updated timestamp, don't trigger yet another reconcile.
+func secretDataChangedPredicate() predicate.Predicate {
+	return predicate.Funcs{
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			oldSecret, ok := e.ObjectOld.(*core_v1.Secret)
+			if !ok {
+				return false
+			}
+			newSecret, ok := e.ObjectNew.(*core_v1.Secret)
+			if !ok {
+				return false
+			}
+			return !reflect.DeepEqual(oldSecret.Data, newSecret.Data)
+		},
+	}
+}
+
+// secretOwnerRequests maps a secret to reconciles of its owners of the given kind, both those in the owner
+// references and those in the owners annotation, which replaces the owner references without them.
+func secretOwnerRequests(gvk schema.GroupVersionKind) handler.MapFunc {
+	return func(_ context.Context, obj client.Object) []reconcile.Request {
+		var requests []reconcile.Request
+		for _, ownerReference := range ownerReferencesOf(obj) {
+			gv, err := schema.ParseGroupVersion(ownerReference.APIVersion)
+			if err != nil || gv.Group != gvk.Group || ownerReference.Kind != gvk.Kind {
+				continue
+			}
+			requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Namespace: obj.GetNamespace(), Name: ownerReference.Name}})
+		}
+		return requests
+	}
+}
+
+// relevantChangePredicate only passes updates changing the spec, the annotations or the labels of an object, so
+// that status-only and resync updates don't trigger a reconcile. Controllers reading the status pass a predicate
+// for the status fields they depend on. Deletion bumps the generation, so finalizers still run.
+func relevantChangePredicate(statusChanged ...predicate.Predicate) predicate.Predicate {
+	return predicate.Or(append([]predicate.Predicate{
+		predicate.GenerationChangedPredicate{},
+		predicate.AnnotationChangedPredicate{},
+		predicate.LabelChangedPredicate{},
+	}, statusChanged...)...)
+}
+
+// requeueInterval returns how long to wait before retrying the object after a temporary failure.
+// The requeue-interval annotation overrides the default, if it is a valid duration within bounds.
+func requeueInterval(ctx context.Context, obj client.Object) time.Duration {
+	logger := log.FromContext(ctx)
+
+	value, ok := obj.GetAnnotations()[requeueIntervalAnnotation]
+	if !ok {
+		return defaultRequeueInterval
+	}
+	interval, err := time.ParseDuration(value)
+	if err != nil {
+		logger.Info("Ignoring invalid requeue interval", "value", value, "error", err)
+		return defaultRequeueInterval
+	}
+	if interval < minRequeueInterval || interval > maxRequeueInterval {
+		logger.Info("Ignoring requeue interval out of bounds", "value", value, "min", minRequeueInterval, "max", maxRequeueInterval)
+		return defaultRequeueInterval
+	}
+	return interval
+}
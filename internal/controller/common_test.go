@@ -0,0 +1,495 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/k8s-config-connector/pkg/clients/generated/apis/sql/v1beta1"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	core_v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var _ = Describe("Label selector predicate", func() {
+	matching := &v1beta1.SQLUser{
+		ObjectMeta: meta_v1.ObjectMeta{
+			Name:   "matching",
+			Labels: map[string]string{"tenant": "a"},
+		},
+	}
+	nonMatching := &v1beta1.SQLUser{
+		ObjectMeta: meta_v1.ObjectMeta{
+			Name:   "non-matching",
+			Labels: map[string]string{"tenant": "b"},
+		},
+	}
+
+	It("should skip resources not matching the selector", func() {
+		pred := labelSelectorPredicate(labels.SelectorFromSet(labels.Set{"tenant": "a"}))
+
+		Expect(pred.Create(event.CreateEvent{Object: matching})).To(BeTrue())
+		Expect(pred.Create(event.CreateEvent{Object: nonMatching})).To(BeFalse())
+		Expect(pred.Update(event.UpdateEvent{ObjectOld: nonMatching, ObjectNew: nonMatching})).To(BeFalse())
+	})
+
+	It("should accept everything without a selector", func() {
+		pred := labelSelectorPredicate(nil)
+
+		Expect(pred.Create(event.CreateEvent{Object: matching})).To(BeTrue())
+		Expect(pred.Create(event.CreateEvent{Object: nonMatching})).To(BeTrue())
+	})
+})
+
+var _ = Describe("Owner references", func() {
+	newSecret := func(ownerReferences ...meta_v1.OwnerReference) *meta_v1.ObjectMeta {
+		return &meta_v1.ObjectMeta{
+			Name:            "test-secret",
+			Labels:          map[string]string{managedByKey: sqeletorFqdnId},
+			OwnerReferences: ownerReferences,
+		}
+	}
+	BeforeEach(func() {
+		utilruntime.Must(v1beta1.AddToScheme(scheme.Scheme))
+	})
+	referenceTo := func(owner client.Object) meta_v1.OwnerReference {
+		ref, err := ownerReferenceFor(scheme.Scheme, owner)
+		Expect(err).ToNot(HaveOccurred())
+		return ref
+	}
+	userReference := func() meta_v1.OwnerReference {
+		user := &v1beta1.SQLUser{ObjectMeta: meta_v1.ObjectMeta{Name: "test-user"}}
+		user.SetGroupVersionKind(v1beta1.SQLUserGVK)
+		return referenceTo(user)
+	}
+	certReference := func() meta_v1.OwnerReference {
+		cert := &v1beta1.SQLSSLCert{ObjectMeta: meta_v1.ObjectMeta{Name: "test-cert"}}
+		cert.SetGroupVersionKind(v1beta1.SQLSSLCertGVK)
+		return referenceTo(cert)
+	}
+
+	It("should look up the kind in the scheme for objects without TypeMeta", func() {
+		user := &v1beta1.SQLUser{ObjectMeta: meta_v1.ObjectMeta{Name: "test-user"}}
+
+		ref := referenceTo(user)
+		Expect(ref.APIVersion).To(Equal("sql.cnrm.cloud.google.com/v1beta1"))
+		Expect(ref.Kind).To(Equal("SQLUser"))
+		Expect(ref).To(Equal(userReference()))
+	})
+
+	It("should reject objects of an unexpected api version", func() {
+		user := &v1beta1.SQLUser{ObjectMeta: meta_v1.ObjectMeta{Name: "test-user"}}
+		user.SetGroupVersionKind(v1beta1.SQLUserGVK.GroupVersion().WithKind("SQLInstance"))
+		_, err := ownerReferenceFor(scheme.Scheme, user)
+		Expect(err).To(MatchError(errUnexpectedKind))
+
+		user.SetGroupVersionKind(schema.GroupVersionKind{Group: v1beta1.SQLUserGVK.Group, Version: "v1alpha1", Kind: "SQLUser"})
+		_, err = ownerReferenceFor(scheme.Scheme, user)
+		Expect(err).To(MatchError(errUnexpectedKind))
+	})
+
+	It("should mark new owner references as controller and block owner deletion", func() {
+		ref := userReference()
+		Expect(ref.Controller).To(HaveValue(BeTrue()))
+		Expect(ref.BlockOwnerDeletion).To(HaveValue(BeTrue()))
+	})
+
+	It("should recognize and upgrade owner references without the controller flag", func() {
+		legacy := userReference()
+		legacy.Controller = nil
+		legacy.BlockOwnerDeletion = nil
+		secret := newSecret(legacy)
+
+		Expect(validateOwnership(userReference(), secret)).To(Succeed())
+		ensureOwnerReference(userReference(), secret)
+
+		Expect(secret.OwnerReferences).To(HaveLen(1))
+		Expect(secret.OwnerReferences[0].Controller).To(HaveValue(BeTrue()))
+		Expect(secret.OwnerReferences[0].BlockOwnerDeletion).To(HaveValue(BeTrue()))
+	})
+
+	It("should only mark one co-owner as controller", func() {
+		secret := newSecret(userReference())
+
+		Expect(validateOwnership(certReference(), secret, sharedSecretCoOwners(certReference(), secret)...)).To(Succeed())
+		ensureOwnerReference(certReference(), secret)
+
+		Expect(secret.OwnerReferences).To(HaveLen(2))
+		Expect(secret.OwnerReferences[0].Controller).To(HaveValue(BeTrue()))
+		Expect(secret.OwnerReferences[1].Controller).To(HaveValue(BeFalse()))
+		Expect(secret.OwnerReferences[1].BlockOwnerDeletion).To(HaveValue(BeTrue()))
+	})
+
+	It("should validate a combined secret from either owner", func() {
+		secret := newSecret(userReference(), certReference())
+
+		Expect(validateOwnership(userReference(), secret, sharedSecretCoOwners(userReference(), secret)...)).To(Succeed())
+		Expect(validateOwnership(certReference(), secret, sharedSecretCoOwners(certReference(), secret)...)).To(Succeed())
+	})
+
+	It("should reject a combined secret without co-owners", func() {
+		secret := newSecret(userReference(), certReference())
+
+		Expect(validateOwnership(userReference(), secret)).To(MatchError(errMultipleOwners))
+	})
+
+	It("should reject a combined secret validated by an unrelated owner", func() {
+		secret := newSecret(userReference(), certReference())
+		instance := &v1beta1.SQLInstance{ObjectMeta: meta_v1.ObjectMeta{Name: "test-instance"}}
+		instance.SetGroupVersionKind(v1beta1.SQLInstanceGVK)
+
+		Expect(validateOwnership(referenceTo(instance), secret, sharedSecretCoOwners(referenceTo(instance), secret)...)).To(MatchError(errMultipleOwners))
+	})
+
+	It("should let several users co-own a secret", func() {
+		secret := newSecret(userReference(), certReference())
+		otherUser := userReference()
+		otherUser.Name = "other-user"
+
+		Expect(validateOwnership(otherUser, secret, sharedSecretCoOwners(otherUser, secret)...)).To(Succeed())
+		ensureOwnerReference(otherUser, secret)
+		Expect(secret.OwnerReferences).To(HaveLen(3))
+
+		Expect(validateOwnership(userReference(), secret, sharedSecretCoOwners(userReference(), secret)...)).To(Succeed())
+		Expect(validateOwnership(certReference(), secret, sharedSecretCoOwners(certReference(), secret)...)).To(Succeed())
+	})
+
+	It("should reject a secret co-owned by a kind that doesn't share secrets", func() {
+		instance := &v1beta1.SQLInstance{ObjectMeta: meta_v1.ObjectMeta{Name: "test-instance"}}
+		instance.SetGroupVersionKind(v1beta1.SQLInstanceGVK)
+		secret := newSecret(userReference(), referenceTo(instance))
+
+		Expect(validateOwnership(userReference(), secret, sharedSecretCoOwners(userReference(), secret)...)).To(MatchError(errOwnedByOther))
+	})
+
+	It("should reject two owners of the same co-owner kind", func() {
+		otherCert := certReference()
+		otherCert.Name = "other-cert"
+		secret := newSecret(userReference(), certReference(), otherCert)
+
+		Expect(validateOwnership(userReference(), secret, sharedSecretCoOwners(userReference(), secret)...)).To(MatchError(errMultipleOwners))
+	})
+})
+
+var _ = Describe("Reconcile metrics", func() {
+	It("should register the new metrics alongside the deprecated requeue counters", func() {
+		for _, collector := range []prometheus.Collector{
+			reconcileTotalMetric,
+			reconcileDurationMetric,
+			requeueReasonMetric,
+			userRequeuesMetric,
+			requeuesMetric,
+			instanceRequeuesMetric,
+		} {
+			err := metrics.Registry.Register(collector)
+			Expect(errors.As(err, &prometheus.AlreadyRegisteredError{})).To(BeTrue())
+		}
+	})
+
+	It("should count and time reconciles per controller and result", func() {
+		before := testutil.ToFloat64(reconcileTotalMetric.WithLabelValues("test", reconcileResultSuccess, "", ""))
+
+		observeReconcile("test", reconcileResultSuccess, time.Now(), resourceLabels{})
+
+		Expect(testutil.ToFloat64(reconcileTotalMetric.WithLabelValues("test", reconcileResultSuccess, "", ""))).To(Equal(before + 1))
+		Expect(testutil.CollectAndCount(reconcileDurationMetric, "sqeletor_reconcile_duration_seconds")).To(BeNumerically(">=", 1))
+	})
+
+	It("should only label reconciles with the team and app of the resource when enabled", func() {
+		user := &v1beta1.SQLUser{ObjectMeta: meta_v1.ObjectMeta{
+			Name:      "labeled-user",
+			Namespace: "default",
+			Labels:    map[string]string{teamKey: "test-team", appKey: "test-app"},
+		}}
+
+		Expect(metricResourceLabels(false, user)).To(Equal(resourceLabels{}))
+		resource := metricResourceLabels(true, user)
+		Expect(resource).To(Equal(resourceLabels{team: "test-team", app: "test-app"}))
+		Expect(metricResourceLabels(true, &v1beta1.SQLUser{})).To(Equal(resourceLabels{}))
+
+		before := testutil.ToFloat64(reconcileTotalMetric.WithLabelValues("test", reconcileResultError, "test-team", "test-app"))
+		observeReconcile("test", reconcileResultError, time.Now(), resource)
+		Expect(testutil.ToFloat64(reconcileTotalMetric.WithLabelValues("test", reconcileResultError, "test-team", "test-app"))).To(Equal(before + 1))
+	})
+})
+
+var _ = Describe("Secret data changed predicate", func() {
+	pred := secretDataChangedPredicate()
+	secret := func(annotation, password string) *core_v1.Secret {
+		return &core_v1.Secret{
+			ObjectMeta: meta_v1.ObjectMeta{Annotations: map[string]string{lastUpdatedAnnotation: annotation}},
+			Data:       map[string][]byte{"PASSWORD": []byte(password)},
+		}
+	}
+
+	It("should pass updates changing the data", func() {
+		Expect(pred.Update(event.UpdateEvent{ObjectOld: secret("a", "old"), ObjectNew: secret("a", "new")})).To(BeTrue())
+	})
+
+	It("should skip updates of only the metadata", func() {
+		Expect(pred.Update(event.UpdateEvent{ObjectOld: secret("a", "same"), ObjectNew: secret("b", "same")})).To(BeFalse())
+	})
+})
+
+var _ = Describe("Relevant change predicate", func() {
+	It("should skip status-only and resync updates of a user", func() {
+		pred := relevantChangePredicate()
+		oldUser := &v1beta1.SQLUser{ObjectMeta: meta_v1.ObjectMeta{Generation: 1, ResourceVersion: "1"}}
+
+		resynced := oldUser.DeepCopy()
+		resynced.ResourceVersion = "2"
+		Expect(pred.Update(event.UpdateEvent{ObjectOld: oldUser, ObjectNew: resynced})).To(BeFalse())
+
+		statusOnly := resynced.DeepCopy()
+		statusOnly.Status.ObservedGeneration = ptr.To(int64(1))
+		Expect(pred.Update(event.UpdateEvent{ObjectOld: oldUser, ObjectNew: statusOnly})).To(BeFalse())
+
+		specChanged := oldUser.DeepCopy()
+		specChanged.Generation = 2
+		Expect(pred.Update(event.UpdateEvent{ObjectOld: oldUser, ObjectNew: specChanged})).To(BeTrue())
+
+		annotated := oldUser.DeepCopy()
+		annotated.Annotations = map[string]string{"sqeletor.nais.io/env-var-prefix": "APP"}
+		Expect(pred.Update(event.UpdateEvent{ObjectOld: oldUser, ObjectNew: annotated})).To(BeTrue())
+
+		Expect(pred.Create(event.CreateEvent{Object: oldUser})).To(BeTrue())
+		Expect(pred.Delete(event.DeleteEvent{Object: oldUser})).To(BeTrue())
+	})
+
+	It("should only pass status updates of an instance changing its ips", func() {
+		pred := relevantChangePredicate(instanceIPChangedPredicate())
+		oldInstance := &v1beta1.SQLInstance{
+			ObjectMeta: meta_v1.ObjectMeta{Generation: 1},
+			Status: v1beta1.SQLInstanceStatus{
+				IpAddress: []v1beta1.InstanceIpAddressStatus{{IpAddress: ptr.To("10.0.0.1"), Type: ptr.To("PRIVATE")}},
+			},
+		}
+
+		noop := oldInstance.DeepCopy()
+		noop.Status.ObservedGeneration = ptr.To(int64(1))
+		Expect(pred.Update(event.UpdateEvent{ObjectOld: oldInstance, ObjectNew: noop})).To(BeFalse())
+
+		ipChanged := oldInstance.DeepCopy()
+		ipChanged.Status.IpAddress[0].IpAddress = ptr.To("10.0.0.2")
+		Expect(pred.Update(event.UpdateEvent{ObjectOld: oldInstance, ObjectNew: ipChanged})).To(BeTrue())
+
+		connectionNameChanged := oldInstance.DeepCopy()
+		connectionNameChanged.Status.ConnectionName = ptr.To("project:region:instance")
+		Expect(pred.Update(event.UpdateEvent{ObjectOld: oldInstance, ObjectNew: connectionNameChanged})).To(BeTrue())
+	})
+
+	It("should only pass status updates of a cert changing the certificate", func() {
+		pred := relevantChangePredicate(certStatusChangedPredicate())
+		oldCert := &v1beta1.SQLSSLCert{
+			ObjectMeta: meta_v1.ObjectMeta{Generation: 1},
+			Status:     v1beta1.SQLSSLCertStatus{Cert: ptr.To("cert"), PrivateKey: ptr.To("key"), ServerCaCert: ptr.To("ca")},
+		}
+
+		noop := oldCert.DeepCopy()
+		noop.Status.ObservedGeneration = ptr.To(int64(1))
+		Expect(pred.Update(event.UpdateEvent{ObjectOld: oldCert, ObjectNew: noop})).To(BeFalse())
+
+		rotated := oldCert.DeepCopy()
+		rotated.Status.Cert = ptr.To("rotated")
+		Expect(pred.Update(event.UpdateEvent{ObjectOld: oldCert, ObjectNew: rotated})).To(BeTrue())
+	})
+})
+
+var _ = Describe("Temporary failures", func() {
+	It("should carry the reason alongside the sentinel and the cause", func() {
+		cause := errors.New("no ip")
+		err := temporaryFailureErrorFor(reasonWaitingForInstanceIP, cause)
+
+		Expect(err).To(MatchError(errTemporaryFailure))
+		Expect(err).To(MatchError(cause))
+		Expect(err).To(MatchError("temporary failure: no ip"))
+		Expect(failureReasonOf(err)).To(Equal(reasonWaitingForInstanceIP))
+	})
+
+	It("should keep the reason when wrapped again", func() {
+		err := temporaryFailureError(fmt.Errorf("mutating secret: %w", temporaryFailureErrorFor(reasonWaitingForConnectionName, errors.New("no connection name"))))
+
+		Expect(failureReasonOf(err)).To(Equal(reasonWaitingForConnectionName))
+	})
+
+	It("should tell missing CRDs apart from other api errors", func() {
+		err := temporaryFailureError(fmt.Errorf("failed to get SQLUser: %w", &meta.NoKindMatchError{GroupKind: v1beta1.SQLUserGVK.GroupKind(), SearchedVersions: []string{"v1beta1"}}))
+
+		Expect(failureReasonOf(err)).To(Equal(reasonCRDNotInstalled))
+	})
+
+	It("should default to an api error", func() {
+		Expect(failureReasonOf(temporaryFailureError(errors.New("conflict")))).To(Equal(reasonAPIError))
+	})
+})
+
+var _ = Describe("createOrUpdate", func() {
+	ctx := context.Background()
+	key := types.NamespacedName{Name: "raced-secret", Namespace: "default"}
+
+	// racingClient creates the object written by racer right before our own create, which then fails with AlreadyExists
+	racingClient := func(racer func(*core_v1.Secret)) client.Client {
+		raced := false
+		return fake.NewClientBuilder().WithScheme(scheme.Scheme).WithInterceptorFuncs(interceptor.Funcs{
+			Create: func(ctx context.Context, c client.WithWatch, obj client.Object, opts ...client.CreateOption) error {
+				if !raced {
+					raced = true
+					other := &core_v1.Secret{ObjectMeta: meta_v1.ObjectMeta{Name: obj.GetName(), Namespace: obj.GetNamespace()}}
+					racer(other)
+					Expect(c.Create(ctx, other)).To(Succeed())
+				}
+				return c.Create(ctx, obj, opts...)
+			},
+		}).Build()
+	}
+
+	It("should update the object created by a racing create", func() {
+		c := racingClient(func(other *core_v1.Secret) {
+			other.Labels = map[string]string{managedByKey: sqeletorFqdnId}
+			other.StringData = map[string]string{"theirs": "value"}
+		})
+
+		secret := &core_v1.Secret{ObjectMeta: meta_v1.ObjectMeta{Name: key.Name, Namespace: key.Namespace}}
+		op, err := createOrUpdate(ctx, c, secret, func() error {
+			if secret.StringData == nil {
+				secret.StringData = make(map[string]string)
+			}
+			secret.StringData["ours"] = "value"
+			return nil
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(op).To(Equal(controllerutil.OperationResultUpdated))
+
+		Expect(c.Get(ctx, key, secret)).To(Succeed())
+		Expect(secret.StringData).To(HaveKey("theirs"))
+		Expect(secret.StringData).To(HaveKey("ours"))
+	})
+
+	It("should not carry fields over from the failed create", func() {
+		c := racingClient(func(other *core_v1.Secret) {
+			other.CreationTimestamp = meta_v1.Now()
+		})
+
+		secret := &core_v1.Secret{ObjectMeta: meta_v1.ObjectMeta{Name: key.Name, Namespace: key.Namespace}}
+		_, err := createOrUpdate(ctx, c, secret, func() error {
+			if secret.CreationTimestamp.IsZero() {
+				secret.Labels = map[string]string{managedByKey: sqeletorFqdnId}
+				return nil
+			}
+			return validateOwnership(meta_v1.OwnerReference{Kind: "SQLUser", Name: "test"}, secret)
+		})
+		Expect(err).To(MatchError(errNotManaged))
+	})
+
+	It("should not retry other errors", func() {
+		calls := 0
+		c := fake.NewClientBuilder().WithScheme(scheme.Scheme).WithInterceptorFuncs(interceptor.Funcs{
+			Create: func(ctx context.Context, c client.WithWatch, obj client.Object, opts ...client.CreateOption) error {
+				calls++
+				return apierrors.NewForbidden(core_v1.Resource("secrets"), obj.GetName(), errors.New("forbidden"))
+			},
+		}).Build()
+
+		_, err := createOrUpdate(ctx, c, &core_v1.Secret{ObjectMeta: meta_v1.ObjectMeta{Name: key.Name, Namespace: key.Namespace}}, func() error { return nil })
+		Expect(apierrors.IsForbidden(err)).To(BeTrue())
+		Expect(calls).To(Equal(1))
+	})
+})
+
+var _ = Describe("Secret cleanup finalizer", func() {
+	ctx := context.Background()
+	const kccFinalizer = "cnrm.cloud.google.com/finalizer"
+
+	It("should not drop finalizers added since the owner was read", func() {
+		utilruntime.Must(v1beta1.AddToScheme(scheme.Scheme))
+		user := &v1beta1.SQLUser{ObjectMeta: meta_v1.ObjectMeta{Name: "user", Namespace: "default", Finalizers: []string{kccFinalizer}}}
+		c := fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(user).Build()
+
+		stale := &v1beta1.SQLUser{}
+		Expect(c.Get(ctx, client.ObjectKeyFromObject(user), stale)).To(Succeed())
+		current := stale.DeepCopy()
+		current.Finalizers = append(current.Finalizers, "cnrm.cloud.google.com/deletion-defender")
+		Expect(c.Update(ctx, current)).To(Succeed())
+
+		Expect(ensureSecretCleanupFinalizer(ctx, c, stale)).To(MatchError(errTemporaryFailure))
+
+		Expect(c.Get(ctx, client.ObjectKeyFromObject(user), current)).To(Succeed())
+		Expect(ensureSecretCleanupFinalizer(ctx, c, current)).To(Succeed())
+		Expect(c.Get(ctx, client.ObjectKeyFromObject(user), current)).To(Succeed())
+		Expect(current.Finalizers).To(ConsistOf(kccFinalizer, "cnrm.cloud.google.com/deletion-defender", secretCleanupFinalizer))
+	})
+})
+
+var _ = Describe("Secret owner requests", func() {
+	It("should map a secret to its owners of the kind, also those in the owners annotation", func() {
+		secret := &core_v1.Secret{ObjectMeta: meta_v1.ObjectMeta{
+			Name:      "secret",
+			Namespace: "default",
+			OwnerReferences: []meta_v1.OwnerReference{
+				{APIVersion: "sql.cnrm.cloud.google.com/v1beta1", Kind: "SQLUser", Name: "referenced"},
+				{APIVersion: "sql.cnrm.cloud.google.com/v1beta1", Kind: "SQLSSLCert", Name: "cert"},
+			},
+		}}
+		setAnnotatedOwnerReferences(secret, []meta_v1.OwnerReference{
+			{APIVersion: "sql.cnrm.cloud.google.com/v1beta1", Kind: "SQLUser", Name: "annotated"},
+			{APIVersion: "example.com/v1", Kind: "SQLUser", Name: "other-group"},
+		})
+
+		requests := secretOwnerRequests(v1beta1.SQLUserGVK)(context.Background(), secret)
+		Expect(requests).To(ConsistOf(
+			HaveField("NamespacedName", types.NamespacedName{Namespace: "default", Name: "referenced"}),
+			HaveField("NamespacedName", types.NamespacedName{Namespace: "default", Name: "annotated"}),
+		))
+	})
+})
+
+var _ = Describe("Owner annotation", func() {
+	It("should qualify the annotation with the owner", func() {
+		ownerReference := meta_v1.OwnerReference{Kind: "SQLUser", Name: "app-user"}
+		Expect(ownerAnnotation(ownerReference, managedKeysAnnotation)).To(Equal("app-user.sqluser.sqeletor.nais.io/managed-keys"))
+	})
+
+	It("should shorten long owner names to a valid and distinct annotation", func() {
+		long := strings.Repeat("a", 240)
+		first := ownerAnnotation(meta_v1.OwnerReference{Kind: "SQLSSLCert", Name: long + "-first"}, sourceGenerationAnnotation)
+		second := ownerAnnotation(meta_v1.OwnerReference{Kind: "SQLSSLCert", Name: long + "-second"}, sourceGenerationAnnotation)
+		Expect(validation.IsQualifiedName(first)).To(BeEmpty())
+		Expect(validation.IsQualifiedName(second)).To(BeEmpty())
+		Expect(first).ToNot(Equal(second))
+		Expect(first).To(HaveSuffix(".sqlsslcert.sqeletor.nais.io/source-generation"))
+	})
+})
+
+// drainEvents returns the events recorded so far, so that assertions cover all of them rather than the first.
+func drainEvents(recorder *record.FakeRecorder) []string {
+	var events []string
+	for {
+		select {
+		case event := <-recorder.Events:
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
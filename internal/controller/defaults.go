@@ -0,0 +1,138 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	nais_io_v1alpha1 "github.com/nais/liberator/pkg/apis/nais.io/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/yaml"
+)
+
+// Defaults are cluster wide defaults, used when a resource lacks the corresponding annotation.
+type Defaults struct {
+	SSLMode   string `json:"sslMode,omitempty"`
+	MountPath string `json:"mountPath,omitempty"`
+	EmitURLs  *bool  `json:"emitURLs,omitempty"`
+	// AllowSSLModeDisable lets users ask for unencrypted connections with the ssl mode annotation, for clusters
+	// running against the Cloud SQL emulator or a local postgres. Never set it in production.
+	AllowSSLModeDisable bool `json:"allowSSLModeDisable,omitempty"`
+}
+
+func (d Defaults) sslMode() string {
+	if d.SSLMode == "" {
+		return sslModeVerifyCA
+	}
+	return d.SSLMode
+}
+
+func (d Defaults) mountPath() string {
+	if d.MountPath == "" {
+		return nais_io_v1alpha1.DefaultSqeletorMountPath
+	}
+	return d.MountPath
+}
+
+func (d Defaults) emitURLs() bool {
+	return d.EmitURLs == nil || *d.EmitURLs
+}
+
+// LoadDefaults reads and validates defaults from a YAML file. An empty file is rejected, as it is more likely caught
+// half-written than meant to clear the defaults; use {} for the built-in defaults.
+func LoadDefaults(path string) (Defaults, error) {
+	defaults := Defaults{}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return defaults, fmt.Errorf("reading defaults file: %w", err)
+	}
+	var document map[string]any
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return defaults, fmt.Errorf("parsing defaults file: %w", err)
+	}
+	if document == nil {
+		return defaults, fmt.Errorf("defaults file is empty")
+	}
+	if err := yaml.UnmarshalStrict(data, &defaults); err != nil {
+		return defaults, fmt.Errorf("parsing defaults file: %w", err)
+	}
+
+	if defaults.SSLMode != "" && !slices.Contains(supportedSSLModes, defaults.SSLMode) {
+		return defaults, fmt.Errorf("unsupported default ssl mode %q", defaults.SSLMode)
+	}
+	if defaults.MountPath != "" && !filepath.IsAbs(defaults.MountPath) {
+		return defaults, fmt.Errorf("default mount path %q is not absolute", defaults.MountPath)
+	}
+
+	return defaults, nil
+}
+
+// DefaultsHolder holds the current Defaults and is safe for concurrent use.
+// A nil holder returns the built-in defaults.
+type DefaultsHolder struct {
+	mu       sync.RWMutex
+	defaults Defaults
+}
+
+func (h *DefaultsHolder) Get() Defaults {
+	if h == nil {
+		return Defaults{}
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.defaults
+}
+
+func (h *DefaultsHolder) Set(defaults Defaults) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.defaults = defaults
+}
+
+// Watch reloads the defaults whenever the file changes, until the context is cancelled.
+// Invalid files are logged and ignored, keeping the previous defaults.
+func (h *DefaultsHolder) Watch(ctx context.Context, path string) error {
+	logger := log.FromContext(ctx).WithValues("path", path)
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("creating defaults watcher: %w", err)
+	}
+	defer watcher.Close()
+
+	// mounted config maps are updated by swapping symlinks, so watch the directory rather than the file
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		return fmt.Errorf("watching defaults file: %w", err)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if event.Has(fsnotify.Chmod) {
+				continue
+			}
+			defaults, err := LoadDefaults(path)
+			if err != nil {
+				logger.Error(err, "failed to reload defaults, keeping previous")
+				continue
+			}
+			h.Set(defaults)
+			logger.Info("Reloaded defaults")
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			logger.Error(err, "error watching defaults file")
+		}
+	}
+}
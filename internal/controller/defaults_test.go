@@ -0,0 +1,94 @@
+package controller
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"k8s.io/utils/ptr"
+)
+
+var _ = Describe("Defaults", func() {
+	var path string
+
+	BeforeEach(func() {
+		path = filepath.Join(GinkgoT().TempDir(), "defaults.yaml")
+	})
+
+	// write to a temporary file and rename it into place, like a config map update, so the
+	// watcher never observes a truncated file
+	writeDefaults := func(content string) {
+		tmp := path + ".tmp"
+		Expect(os.WriteFile(tmp, []byte(content), 0o600)).To(Succeed())
+		Expect(os.Rename(tmp, path)).To(Succeed())
+	}
+
+	It("should use built-in defaults when nothing is configured", func() {
+		var holder *DefaultsHolder
+		defaults := holder.Get()
+
+		Expect(defaults.sslMode()).To(Equal(sslModeVerifyCA))
+		Expect(defaults.mountPath()).To(Equal("/var/run/secrets/nais.io/sqlcertificate"))
+		Expect(defaults.emitURLs()).To(BeTrue())
+	})
+
+	It("should load defaults from a file", func() {
+		writeDefaults("sslMode: require\nmountPath: /certs\nemitURLs: false\n")
+
+		defaults, err := LoadDefaults(path)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(defaults).To(Equal(Defaults{SSLMode: "require", MountPath: "/certs", EmitURLs: ptr.To(false)}))
+	})
+
+	DescribeTable("rejecting invalid files",
+		func(content string) {
+			writeDefaults(content)
+			_, err := LoadDefaults(path)
+			Expect(err).To(HaveOccurred())
+		},
+		Entry("unsupported ssl mode", "sslMode: disable\n"),
+		Entry("relative mount path", "mountPath: certs\n"),
+		Entry("unknown field", "sslModes: require\n"),
+		Entry("empty file", ""),
+		Entry("only comments", "# sslMode: require\n"),
+		Entry("truncated value", "emitURLs: fal"),
+	)
+
+	It("should load the built-in defaults from an empty document", func() {
+		writeDefaults("{}\n")
+
+		defaults, err := LoadDefaults(path)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(defaults).To(Equal(Defaults{}))
+	})
+
+	It("should reload defaults when the file changes", func() {
+		writeDefaults("sslMode: verify-full\n")
+		defaults, err := LoadDefaults(path)
+		Expect(err).ToNot(HaveOccurred())
+
+		holder := &DefaultsHolder{}
+		holder.Set(defaults)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			defer GinkgoRecover()
+			Expect(holder.Watch(ctx, path)).To(Succeed())
+		}()
+
+		Consistently(func() string { return holder.Get().SSLMode }, 200*time.Millisecond).Should(Equal("verify-full"))
+
+		writeDefaults("sslMode: require\n")
+		Eventually(func() string { return holder.Get().SSLMode }, 5*time.Second).Should(Equal("require"))
+
+		writeDefaults("sslMode: bogus\n")
+		Consistently(func() string { return holder.Get().SSLMode }, 200*time.Millisecond).Should(Equal("require"))
+
+		writeDefaults("")
+		Consistently(func() string { return holder.Get().SSLMode }, 200*time.Millisecond).Should(Equal("require"))
+	})
+})
@@ -0,0 +1,117 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	core_v1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// managedByUs selects the resources carrying our managed-by label.
+var managedByUs = client.MatchingLabels{managedByKey: sqeletorFqdnId}
+
+// listManagedSecrets lists the secrets we manage, in all namespaces.
+func listManagedSecrets(ctx context.Context, c client.Reader) ([]core_v1.Secret, error) {
+	secrets := &core_v1.SecretList{}
+	if err := c.List(ctx, secrets, managedByUs); err != nil {
+		return nil, fmt.Errorf("failed to list secrets: %w", err)
+	}
+	return secrets.Items, nil
+}
+
+// listManagedNetpols lists the network policies we manage, in all namespaces.
+func listManagedNetpols(ctx context.Context, c client.Reader) ([]netv1.NetworkPolicy, error) {
+	netpols := &netv1.NetworkPolicyList{}
+	if err := c.List(ctx, netpols, managedByUs); err != nil {
+		return nil, fmt.Errorf("failed to list network policies: %w", err)
+	}
+	return netpols.Items, nil
+}
+
+// inventoryOwner is a resource owning a managed resource, with the secret keys it writes.
+type inventoryOwner struct {
+	APIVersion string   `json:"apiVersion"`
+	Kind       string   `json:"kind"`
+	Name       string   `json:"name"`
+	Keys       []string `json:"keys,omitempty"`
+}
+
+// inventoryEntry describes a managed resource. Secrets are listed by their key names only, never their values.
+type inventoryEntry struct {
+	Kind        string           `json:"kind"`
+	Namespace   string           `json:"namespace"`
+	Name        string           `json:"name"`
+	Owners      []inventoryOwner `json:"owners"`
+	Keys        []string         `json:"keys,omitempty"`
+	LastUpdated string           `json:"lastUpdated,omitempty"`
+}
+
+// inventory returns the managed secrets and network policies, with their owners.
+func inventory(ctx context.Context, c client.Reader) ([]inventoryEntry, error) {
+	secrets, err := listManagedSecrets(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	netpols, err := listManagedNetpols(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]inventoryEntry, 0, len(secrets)+len(netpols))
+	for i := range secrets {
+		secret := &secrets[i]
+		entry := newInventoryEntry("Secret", secret)
+		for j, owner := range entry.Owners {
+			entry.Owners[j].Keys = splitManagedKeys(secret.Annotations[ownerManagedKeysAnnotation(meta_v1.OwnerReference{Kind: owner.Kind, Name: owner.Name})])
+		}
+		entry.Keys = splitManagedKeys(secret.Annotations[managedKeysAnnotation])
+		entries = append(entries, entry)
+	}
+	for i := range netpols {
+		entries = append(entries, newInventoryEntry("NetworkPolicy", &netpols[i]))
+	}
+	return entries, nil
+}
+
+func newInventoryEntry(kind string, obj client.Object) inventoryEntry {
+	owners := []inventoryOwner{}
+	for _, ownerReference := range ownerReferencesOf(obj) {
+		owners = append(owners, inventoryOwner{APIVersion: ownerReference.APIVersion, Kind: ownerReference.Kind, Name: ownerReference.Name})
+	}
+	return inventoryEntry{
+		Kind:        kind,
+		Namespace:   obj.GetNamespace(),
+		Name:        obj.GetName(),
+		Owners:      owners,
+		LastUpdated: obj.GetAnnotations()[lastUpdatedAnnotation],
+	}
+}
+
+// NewInventoryHandler serves GET /inventory, listing the resources we manage as JSON, for requests with the token
+// as bearer token.
+func NewInventoryHandler(c client.Reader, token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /inventory", func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r, token) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		entries, err := inventory(r.Context(), c)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(entries); err != nil {
+			log.FromContext(r.Context()).Error(err, "failed to write inventory")
+		}
+	})
+	return mux
+}
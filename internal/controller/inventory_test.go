@@ -0,0 +1,102 @@
+package controller
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/GoogleCloudPlatform/k8s-config-connector/pkg/clients/generated/apis/sql/v1beta1"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	core_v1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+var _ = Describe("Inventory", func() {
+	var handler http.Handler
+
+	BeforeEach(func() {
+		utilruntime.Must(v1beta1.AddToScheme(scheme.Scheme))
+		userReference := meta_v1.OwnerReference{APIVersion: "sql.cnrm.cloud.google.com/v1beta1", Kind: "SQLUser", Name: "app-user"}
+		certReference := meta_v1.OwnerReference{APIVersion: "sql.cnrm.cloud.google.com/v1beta1", Kind: "SQLSSLCert", Name: "app-cert"}
+		instanceReference := meta_v1.OwnerReference{APIVersion: "sql.cnrm.cloud.google.com/v1beta1", Kind: "SQLInstance", Name: "app-instance"}
+
+		secret := &core_v1.Secret{
+			ObjectMeta: meta_v1.ObjectMeta{
+				Name:            "app-secret",
+				Namespace:       "team-a",
+				Labels:          map[string]string{managedByKey: sqeletorFqdnId},
+				OwnerReferences: []meta_v1.OwnerReference{userReference, certReference},
+				Annotations: map[string]string{
+					lastUpdatedAnnotation:                     "2024-01-01T12:00:00Z",
+					managedKeysAnnotation:                     "APP_PASSWORD,APP_URL,cert.pem",
+					ownerManagedKeysAnnotation(userReference): "APP_PASSWORD,APP_URL",
+					ownerManagedKeysAnnotation(certReference): "cert.pem",
+				},
+			},
+			Data: map[string][]byte{"APP_PASSWORD": []byte("hunter2")},
+		}
+		netpol := &netv1.NetworkPolicy{
+			ObjectMeta: meta_v1.ObjectMeta{
+				Name:            "sql-app-instance-resource-id",
+				Namespace:       "team-a",
+				Labels:          map[string]string{managedByKey: sqeletorFqdnId},
+				OwnerReferences: []meta_v1.OwnerReference{instanceReference},
+			},
+		}
+		unmanaged := &core_v1.Secret{ObjectMeta: meta_v1.ObjectMeta{Name: "other-secret", Namespace: "team-a"}}
+
+		c := fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(secret, netpol, unmanaged).Build()
+		handler = NewInventoryHandler(c, "secret-token")
+	})
+
+	get := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/inventory", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	It("should list the managed resources with their owners and keys", func() {
+		rec := get("secret-token")
+		Expect(rec.Code).To(Equal(http.StatusOK))
+		Expect(rec.Header().Get("Content-Type")).To(Equal("application/json"))
+		Expect(rec.Body.String()).ToNot(ContainSubstring("hunter2"))
+
+		var entries []map[string]any
+		Expect(json.Unmarshal(rec.Body.Bytes(), &entries)).To(Succeed())
+		Expect(entries).To(ConsistOf(
+			map[string]any{
+				"kind":        "Secret",
+				"namespace":   "team-a",
+				"name":        "app-secret",
+				"keys":        []any{"APP_PASSWORD", "APP_URL", "cert.pem"},
+				"lastUpdated": "2024-01-01T12:00:00Z",
+				"owners": []any{
+					map[string]any{"apiVersion": "sql.cnrm.cloud.google.com/v1beta1", "kind": "SQLUser", "name": "app-user", "keys": []any{"APP_PASSWORD", "APP_URL"}},
+					map[string]any{"apiVersion": "sql.cnrm.cloud.google.com/v1beta1", "kind": "SQLSSLCert", "name": "app-cert", "keys": []any{"cert.pem"}},
+				},
+			},
+			map[string]any{
+				"kind":      "NetworkPolicy",
+				"namespace": "team-a",
+				"name":      "sql-app-instance-resource-id",
+				"owners": []any{
+					map[string]any{"apiVersion": "sql.cnrm.cloud.google.com/v1beta1", "kind": "SQLInstance", "name": "app-instance"},
+				},
+			},
+		))
+	})
+
+	It("should reject requests without the token", func() {
+		Expect(get("").Code).To(Equal(http.StatusUnauthorized))
+		Expect(get("wrong-token").Code).To(Equal(http.StatusUnauthorized))
+	})
+})
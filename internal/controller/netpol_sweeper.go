@@ -0,0 +1,92 @@
+package controller
+
+import (
+	"context"
+	"time"
+
+	"github.com/GoogleCloudPlatform/k8s-config-connector/pkg/clients/generated/apis/sql/v1beta1"
+	netv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// NetpolSweeper periodically deletes managed network policies whose SQLInstance no longer exists.
+// Normally these are garbage collected through their owner reference, but that is not guaranteed
+// if garbage collection is disabled or the owner reference has been removed.
+type NetpolSweeper struct {
+	client.Client
+	Interval time.Duration
+}
+
+// NeedLeaderElection makes sure only the leader sweeps.
+func (s *NetpolSweeper) NeedLeaderElection() bool {
+	return true
+}
+
+func (s *NetpolSweeper) Start(ctx context.Context) error {
+	logger := log.FromContext(ctx).WithName("netpol-sweeper")
+
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if err := s.sweep(ctx); err != nil {
+				logger.Error(err, "failed to sweep orphaned network policies")
+			}
+		}
+	}
+}
+
+func (s *NetpolSweeper) sweep(ctx context.Context) error {
+	logger := log.FromContext(ctx).WithName("netpol-sweeper")
+
+	netpols, err := listManagedNetpols(ctx, s.Client)
+	if err != nil {
+		return err
+	}
+
+	for i := range netpols {
+		netpol := &netpols[i]
+
+		instanceName := netpolInstanceName(netpol)
+		if instanceName == "" {
+			logger.V(4).Info("ignoring: unable to tell which instance network policy belongs to", "netpol", netpol.Name, "namespace", netpol.Namespace)
+			continue
+		}
+
+		err := s.Get(ctx, types.NamespacedName{Name: instanceName, Namespace: netpol.Namespace}, &v1beta1.SQLInstance{})
+		if err == nil {
+			continue
+		}
+		// one failing item shouldn't keep the rest from being swept, they are retried on the next sweep
+		if !apierrors.IsNotFound(err) {
+			logger.Error(err, "failed to get SQLInstance, skipping network policy", "netpol", netpol.Name, "namespace", netpol.Namespace, "instance", instanceName)
+			continue
+		}
+
+		if err := s.Delete(ctx, netpol); client.IgnoreNotFound(err) != nil {
+			logger.Error(err, "failed to delete orphaned network policy", "netpol", netpol.Name, "namespace", netpol.Namespace, "instance", instanceName)
+			continue
+		}
+		logger.Info("Deleted orphaned network policy", "netpol", netpol.Name, "namespace", netpol.Namespace, "instance", instanceName)
+	}
+
+	return nil
+}
+
+// netpolInstanceName returns the name of the SQLInstance the network policy was created for,
+// preferring the owner reference and falling back to the instance label.
+func netpolInstanceName(netpol *netv1.NetworkPolicy) string {
+	for _, ownerReference := range netpol.OwnerReferences {
+		if ownerReference.Kind == "SQLInstance" {
+			return ownerReference.Name
+		}
+	}
+	return netpol.Labels[sqlInstanceLabelKey]
+}
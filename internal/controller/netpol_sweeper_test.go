@@ -0,0 +1,100 @@
+package controller
+
+import (
+	"context"
+
+	"github.com/GoogleCloudPlatform/k8s-config-connector/pkg/clients/generated/apis/sql/v1beta1"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	netv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+)
+
+var _ = Describe("Netpol sweeper", func() {
+	ctx := context.Background()
+	const namespace = "default"
+
+	var k8sClient client.Client
+	var sweeper *NetpolSweeper
+
+	netpol := func(name string, labels map[string]string, ownerReferences ...meta_v1.OwnerReference) *netv1.NetworkPolicy {
+		return &netv1.NetworkPolicy{
+			ObjectMeta: meta_v1.ObjectMeta{
+				Name:            name,
+				Namespace:       namespace,
+				Labels:          labels,
+				OwnerReferences: ownerReferences,
+			},
+		}
+	}
+
+	BeforeEach(func() {
+		utilruntime.Must(v1beta1.AddToScheme(scheme.Scheme))
+
+		existingInstance := &v1beta1.SQLInstance{
+			ObjectMeta: meta_v1.ObjectMeta{
+				Name:      "existing-instance",
+				Namespace: namespace,
+			},
+		}
+
+		k8sClient = fake.NewClientBuilder().
+			WithScheme(scheme.Scheme).
+			WithObjects(
+				existingInstance,
+				netpol("sql-existing-instance", map[string]string{managedByKey: sqeletorFqdnId}, meta_v1.OwnerReference{Kind: "SQLInstance", Name: "existing-instance"}),
+				netpol("sql-deleted-instance", map[string]string{managedByKey: sqeletorFqdnId}, meta_v1.OwnerReference{Kind: "SQLInstance", Name: "deleted-instance"}),
+				netpol("sql-stripped-instance", map[string]string{managedByKey: sqeletorFqdnId, sqlInstanceLabelKey: "stripped-instance"}),
+				netpol("sql-unknown-instance", map[string]string{managedByKey: sqeletorFqdnId}),
+				netpol("unmanaged", nil, meta_v1.OwnerReference{Kind: "SQLInstance", Name: "deleted-instance"}),
+			).
+			Build()
+		sweeper = &NetpolSweeper{Client: k8sClient}
+	})
+
+	exists := func(name string) bool {
+		err := k8sClient.Get(ctx, types.NamespacedName{Name: name, Namespace: namespace}, &netv1.NetworkPolicy{})
+		if apierrors.IsNotFound(err) {
+			return false
+		}
+		Expect(err).ToNot(HaveOccurred())
+		return true
+	}
+
+	It("should delete managed network policies whose instance no longer exists", func() {
+		Expect(sweeper.sweep(ctx)).To(Succeed())
+
+		Expect(exists("sql-deleted-instance")).To(BeFalse())
+		Expect(exists("sql-stripped-instance")).To(BeFalse())
+	})
+
+	It("should sweep the remaining network policies when one fails", func() {
+		sweeper.Client = interceptor.NewClient(k8sClient.(client.WithWatch), interceptor.Funcs{
+			Get: func(ctx context.Context, c client.WithWatch, key client.ObjectKey, obj client.Object, opts ...client.GetOption) error {
+				if key.Name == "deleted-instance" {
+					return apierrors.NewServiceUnavailable("unavailable")
+				}
+				return c.Get(ctx, key, obj, opts...)
+			},
+		})
+		Expect(sweeper.sweep(ctx)).To(Succeed())
+
+		Expect(exists("sql-deleted-instance")).To(BeTrue())
+		Expect(exists("sql-stripped-instance")).To(BeFalse())
+	})
+
+	It("should keep network policies whose instance exists, is unknown or that are not managed", func() {
+		Expect(sweeper.sweep(ctx)).To(Succeed())
+
+		Expect(exists("sql-existing-instance")).To(BeTrue())
+		Expect(exists("sql-unknown-instance")).To(BeTrue())
+		Expect(exists("unmanaged")).To(BeTrue())
+	})
+})
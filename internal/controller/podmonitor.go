@@ -0,0 +1,112 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/GoogleCloudPlatform/k8s-config-connector/pkg/clients/generated/apis/sql/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	createPodMonitorAnnotation = "sqeletor.nais.io/create-podmonitor"
+	// podMonitorPort is the name of the container port the cloud sql proxy serves its metrics on
+	podMonitorPort = "proxy-metrics"
+)
+
+// podMonitorGVK is the Prometheus Operator PodMonitor. We use unstructured objects rather than depending on
+// the operator's types, as the CRD is optional in the cluster.
+var podMonitorGVK = schema.GroupVersionKind{Group: "monitoring.coreos.com", Version: "v1", Kind: "PodMonitor"}
+
+// reconcilePodMonitor creates a PodMonitor scraping the app's proxy pods if the instance asks for it,
+// and removes a previously created one if it no longer does. Does nothing if the CRD is not installed.
+func (r *SQLInstanceReconciler) reconcilePodMonitor(ctx context.Context, sqlInstance *v1beta1.SQLInstance, name, appName string) error {
+	logger := log.FromContext(ctx)
+
+	if _, err := r.RESTMapper().RESTMapping(podMonitorGVK.GroupKind(), podMonitorGVK.Version); err != nil {
+		if meta.IsNoMatchError(err) {
+			logger.V(4).Info("ignoring: PodMonitor CRD not installed")
+			return nil
+		}
+		return temporaryFailureError(fmt.Errorf("failed to look up PodMonitor CRD: %w", err))
+	}
+
+	ownerReference, err := ownerReferenceFor(r.Scheme, sqlInstance)
+	if err != nil {
+		return err
+	}
+
+	podMonitor := &unstructured.Unstructured{}
+	podMonitor.SetGroupVersionKind(podMonitorGVK)
+	podMonitor.SetName(name)
+	podMonitor.SetNamespace(sqlInstance.Namespace)
+
+	if !boolAnnotation(sqlInstance, createPodMonitorAnnotation, false) {
+		existing := &unstructured.Unstructured{}
+		existing.SetGroupVersionKind(podMonitorGVK)
+		err := r.Get(ctx, types.NamespacedName{Name: name, Namespace: sqlInstance.Namespace}, existing)
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return temporaryFailureError(fmt.Errorf("failed to get PodMonitor: %w", err))
+		}
+		if validateOwnership(ownerReference, existing) != nil {
+			return nil
+		}
+		if err := r.Delete(ctx, existing); client.IgnoreNotFound(err) != nil {
+			return temporaryFailureError(fmt.Errorf("failed to delete PodMonitor: %w", err))
+		}
+		logger.Info("PodMonitor deleted")
+		return nil
+	}
+
+	op, err := createOrUpdate(ctx, r.Client, podMonitor, func() error {
+		labels := podMonitor.GetLabels()
+		if labels == nil {
+			labels = make(map[string]string)
+		}
+		// if new resource, add managed-by label. the pod monitor is owned by the sql instance.
+		if creationTimestamp := podMonitor.GetCreationTimestamp(); creationTimestamp.IsZero() {
+			labels[managedByKey] = sqeletorFqdnId
+		} else if err := validateOwnership(ownerReference, podMonitor); err != nil {
+			return err
+		}
+		ensureOwnerReference(ownerReference, podMonitor)
+
+		labels[typeKey] = sqeletorFqdnId
+		labels[appKey] = appName
+		labels[sqlInstanceLabelKey] = sqlInstance.Name
+		labels[teamKey] = sqlInstance.Labels[teamKey]
+		podMonitor.SetLabels(labels)
+
+		return unstructured.SetNestedField(podMonitor.Object, map[string]any{
+			"selector": map[string]any{
+				"matchLabels": map[string]any{
+					appKey: appName,
+				},
+			},
+			"podMetricsEndpoints": []any{
+				map[string]any{
+					"port": podMonitorPort,
+				},
+			},
+		}, "spec")
+	})
+	if err != nil {
+		if errors.Is(err, errPermanentFailure) {
+			return err
+		}
+		return temporaryFailureError(err)
+	}
+
+	logger.Info("PodMonitor reconciled", "operation", op)
+	return nil
+}
@@ -0,0 +1,123 @@
+package controller
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	errNoPrivateKeyBlock  = errors.New("no private key PEM block found")
+	errUnsupportedKeyType = errors.New("unsupported private key type")
+	errCertKeyMismatch    = errors.New("certificate does not match private key")
+)
+
+// decodePrivateKeyPem returns all private key blocks in the PEM input, in order of appearance.
+func decodePrivateKeyPem(in []byte) ([]*pem.Block, error) {
+	var blocks []*pem.Block
+	for {
+		var block *pem.Block
+		block, in = pem.Decode(in)
+		if block == nil {
+			break
+		}
+		if strings.HasSuffix(block.Type, "PRIVATE KEY") {
+			blocks = append(blocks, block)
+		}
+	}
+	if len(blocks) == 0 {
+		return nil, errNoPrivateKeyBlock
+	}
+	return blocks, nil
+}
+
+func parsePrivateKeyBlock(block *pem.Block) (any, error) {
+	var key any
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("%w: PEM block type %q", errUnsupportedKeyType, block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch key.(type) {
+	case *rsa.PrivateKey, *ecdsa.PrivateKey, ed25519.PrivateKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("%w: %T", errUnsupportedKeyType, key)
+	}
+}
+
+// pemToPkcs8Der converts the first private key in the PEM input that can be parsed to PKCS8 DER.
+func pemToPkcs8Der(in []byte) ([]byte, error) {
+	blocks, err := decodePrivateKeyPem(in)
+	if err != nil {
+		return nil, err
+	}
+
+	var errs []error
+	for _, block := range blocks {
+		key, err := parsePrivateKeyBlock(block)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", block.Type, err))
+			continue
+		}
+		return x509.MarshalPKCS8PrivateKey(key)
+	}
+
+	return nil, errors.Join(errs...)
+}
+
+// firstCertificate returns the first certificate in certPem, or nil if there is none or it can't be parsed.
+func firstCertificate(certPem []byte) *x509.Certificate {
+	for block, rest := pem.Decode(certPem); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type == "CERTIFICATE" {
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil
+			}
+			return cert
+		}
+	}
+	return nil
+}
+
+// verifyCertKeyPair checks that the first certificate in certPem is for the first parseable private key in keyPem.
+// A certificate or key that can't be parsed can't be compared, and is not considered a mismatch.
+func verifyCertKeyPair(certPem, keyPem []byte) error {
+	cert := firstCertificate(certPem)
+	if cert == nil {
+		return nil
+	}
+
+	blocks, err := decodePrivateKeyPem(keyPem)
+	if err != nil {
+		return nil
+	}
+	for _, block := range blocks {
+		key, err := parsePrivateKeyBlock(block)
+		if err != nil {
+			continue
+		}
+		publicKey, ok := cert.PublicKey.(interface{ Equal(crypto.PublicKey) bool })
+		if !ok || !publicKey.Equal(key.(crypto.Signer).Public()) {
+			return errCertKeyMismatch
+		}
+		return nil
+	}
+	return nil
+}
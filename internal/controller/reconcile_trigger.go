@@ -0,0 +1,131 @@
+package controller
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// triggerBufferSize is how many triggered reconciles of a kind can wait for its controller to pick them up
+const triggerBufferSize = 100
+
+var (
+	errUnknownKind       = errors.New("no controller for kind")
+	errNotSelected       = errors.New("not selected by the label selector of the controller")
+	errTriggerBufferFull = errors.New("too many reconciles waiting to be picked up")
+)
+
+// ReconcileTrigger enqueues reconciles of named resources on request, without having to touch the resources.
+// Each controller watches the triggered reconciles of its kind.
+type ReconcileTrigger struct {
+	// Reader looks up the labels of triggered resources of controllers with a label selector.
+	Reader client.Reader
+
+	mu    sync.Mutex
+	kinds map[string]triggeredKind
+}
+
+// triggeredKind is where the triggered reconciles of a kind go, and which of them its controller reconciles.
+type triggeredKind struct {
+	ch       chan event.GenericEvent
+	gvk      schema.GroupVersionKind
+	selector labels.Selector
+}
+
+// source returns the triggered reconciles of the kind, for the controller of the kind to watch.
+func (t *ReconcileTrigger) source(gvk schema.GroupVersionKind, selector labels.Selector) source.Source {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.kinds == nil {
+		t.kinds = make(map[string]triggeredKind)
+	}
+	ch := make(chan event.GenericEvent, triggerBufferSize)
+	t.kinds[strings.ToLower(gvk.Kind)] = triggeredKind{ch: ch, gvk: gvk, selector: selector}
+	return source.Channel(ch, &handler.EnqueueRequestForObject{})
+}
+
+// watchTriggered makes the controller reconcile the resources triggered for its kind, if there is a trigger. Like
+// the watches of the controller, the triggered reconciles are limited to the resources matching its label selector.
+func watchTriggered(b *builder.Builder, trigger *ReconcileTrigger, gvk schema.GroupVersionKind, selector labels.Selector) *builder.Builder {
+	if trigger == nil {
+		return b
+	}
+	return b.WatchesRawSource(trigger.source(gvk, selector))
+}
+
+// Trigger enqueues a reconcile of the named resource of the kind. Kinds are matched case-insensitively.
+func (t *ReconcileTrigger) Trigger(ctx context.Context, kind string, key types.NamespacedName) error {
+	t.mu.Lock()
+	triggered, ok := t.kinds[strings.ToLower(kind)]
+	t.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("%w %s", errUnknownKind, kind)
+	}
+
+	obj := &meta_v1.PartialObjectMetadata{ObjectMeta: meta_v1.ObjectMeta{Name: key.Name, Namespace: key.Namespace}}
+	if triggered.selector != nil && !triggered.selector.Empty() {
+		obj.SetGroupVersionKind(triggered.gvk)
+		if err := t.Reader.Get(ctx, key, obj); err != nil {
+			if apierrors.IsNotFound(err) {
+				return fmt.Errorf("%s %s is %w", kind, key, errNotSelected)
+			}
+			return fmt.Errorf("failed to look up %s %s: %w", kind, key, err)
+		}
+		if !triggered.selector.Matches(labels.Set(obj.GetLabels())) {
+			return fmt.Errorf("%s %s is %w", kind, key, errNotSelected)
+		}
+	}
+	select {
+	case triggered.ch <- event.GenericEvent{Object: obj}:
+		return nil
+	default:
+		return fmt.Errorf("%w for kind %s", errTriggerBufferFull, kind)
+	}
+}
+
+// NewReconcileHandler serves POST /reconcile/{kind}/{namespace}/{name} to trigger a reconcile, for requests
+// with the token as bearer token.
+func NewReconcileHandler(trigger *ReconcileTrigger, token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /reconcile/{kind}/{namespace}/{name}", func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r, token) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		key := types.NamespacedName{Namespace: r.PathValue("namespace"), Name: r.PathValue("name")}
+		err := trigger.Trigger(r.Context(), r.PathValue("kind"), key)
+		switch {
+		case errors.Is(err, errUnknownKind), errors.Is(err, errNotSelected):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case errors.Is(err, errTriggerBufferFull):
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusAccepted)
+		}
+	})
+	return mux
+}
+
+// authorized reports whether the request has the token as bearer token. An empty token authorizes nothing.
+func authorized(r *http.Request, token string) bool {
+	bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return token != "" && ok && subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) == 1
+}
@@ -0,0 +1,83 @@
+package controller
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/GoogleCloudPlatform/k8s-config-connector/pkg/clients/generated/apis/sql/v1beta1"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+var _ = Describe("Reconcile trigger", func() {
+	var trigger *ReconcileTrigger
+	var queue workqueue.TypedRateLimitingInterface[reconcile.Request]
+	var handler http.Handler
+
+	BeforeEach(func() {
+		// the source stops distributing events when its context is done
+		ctx, cancel := context.WithCancel(context.Background())
+		DeferCleanup(cancel)
+		trigger = &ReconcileTrigger{}
+		queue = workqueue.NewTypedRateLimitingQueue(workqueue.DefaultTypedControllerRateLimiter[reconcile.Request]())
+		DeferCleanup(queue.ShutDown)
+		Expect(trigger.source(v1beta1.SQLUserGVK, nil).Start(ctx, queue)).To(Succeed())
+		handler = NewReconcileHandler(trigger, "secret-token")
+	})
+
+	post := func(path, token string) int {
+		req := httptest.NewRequest(http.MethodPost, path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	It("should enqueue a reconcile of the named resource", func() {
+		Expect(post("/reconcile/sqluser/team-a/app-user", "secret-token")).To(Equal(http.StatusAccepted))
+
+		Eventually(queue.Len).Should(Equal(1))
+		req, _ := queue.Get()
+		Expect(req).To(Equal(reconcile.Request{NamespacedName: types.NamespacedName{Namespace: "team-a", Name: "app-user"}}))
+	})
+
+	It("should reject requests without the token", func() {
+		Expect(post("/reconcile/sqluser/team-a/app-user", "")).To(Equal(http.StatusUnauthorized))
+		Expect(post("/reconcile/sqluser/team-a/app-user", "wrong-token")).To(Equal(http.StatusUnauthorized))
+		Consistently(queue.Len).Should(BeZero())
+	})
+
+	It("should reject kinds without a controller", func() {
+		Expect(post("/reconcile/sqlinstance/team-a/instance", "secret-token")).To(Equal(http.StatusNotFound))
+	})
+
+	It("should only enqueue resources matching the label selector of the controller", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		DeferCleanup(cancel)
+		utilruntime.Must(v1beta1.AddToScheme(scheme.Scheme))
+		trigger.Reader = fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(
+			&v1beta1.SQLSSLCert{ObjectMeta: meta_v1.ObjectMeta{Name: "selected", Namespace: "team-a", Labels: map[string]string{"tenant": "a"}}},
+			&v1beta1.SQLSSLCert{ObjectMeta: meta_v1.ObjectMeta{Name: "other", Namespace: "team-a", Labels: map[string]string{"tenant": "b"}}},
+		).Build()
+		Expect(trigger.source(v1beta1.SQLSSLCertGVK, labels.SelectorFromSet(labels.Set{"tenant": "a"})).Start(ctx, queue)).To(Succeed())
+
+		Expect(post("/reconcile/sqlsslcert/team-a/other", "secret-token")).To(Equal(http.StatusNotFound))
+		Expect(post("/reconcile/sqlsslcert/team-a/missing", "secret-token")).To(Equal(http.StatusNotFound))
+		Expect(post("/reconcile/sqlsslcert/team-a/selected", "secret-token")).To(Equal(http.StatusAccepted))
+
+		Eventually(queue.Len).Should(Equal(1))
+		req, _ := queue.Get()
+		Expect(req).To(Equal(reconcile.Request{NamespacedName: types.NamespacedName{Namespace: "team-a", Name: "selected"}}))
+	})
+})
@@ -0,0 +1,134 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/GoogleCloudPlatform/k8s-config-connector/pkg/clients/generated/apis/sql/v1beta1"
+	core_v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// secretCleanupFinalizer lets us clean up secrets without owner references, which garbage collection does not handle.
+const secretCleanupFinalizer = "sqeletor.nais.io/secret-cleanup"
+
+// finalizersPatch patches the finalizers of the owner. A merge patch replaces the whole list, so the patch is
+// conditional on the resource version, and fails rather than dropping finalizers added by others since it was read.
+func finalizersPatch(owner client.Object) client.Patch {
+	return client.MergeFromWithOptions(owner.DeepCopyObject().(client.Object), client.MergeFromWithOptimisticLock{})
+}
+
+// ensureSecretCleanupFinalizer adds the secret cleanup finalizer to the owner if it is missing.
+func ensureSecretCleanupFinalizer(ctx context.Context, c client.Client, owner client.Object) error {
+	patch := finalizersPatch(owner)
+	if !controllerutil.AddFinalizer(owner, secretCleanupFinalizer) {
+		return nil
+	}
+	if err := c.Patch(ctx, owner, patch); err != nil {
+		return temporaryFailureError(fmt.Errorf("failed to add finalizer: %w", err))
+	}
+	return nil
+}
+
+// removeSecretCleanupFinalizer removes the secret cleanup finalizer from the owner if it is present.
+func removeSecretCleanupFinalizer(ctx context.Context, c client.Client, owner client.Object) error {
+	patch := finalizersPatch(owner)
+	if !controllerutil.RemoveFinalizer(owner, secretCleanupFinalizer) {
+		return nil
+	}
+	if err := c.Patch(ctx, owner, patch); client.IgnoreNotFound(err) != nil {
+		return temporaryFailureError(fmt.Errorf("failed to remove finalizer: %w", err))
+	}
+	return nil
+}
+
+// cleanupSecrets is run when an owner with the secret cleanup finalizer is deleted. It releases the owner's
+// secrets, and then the owner by removing the finalizer.
+func cleanupSecrets(ctx context.Context, c client.Client, owner client.Object, secretNames ...string) error {
+	for _, secretName := range secretNames {
+		if err := releaseSecret(ctx, c, owner, secretName, ""); err != nil {
+			return err
+		}
+	}
+	return removeSecretCleanupFinalizer(ctx, c, owner)
+}
+
+// releaseSecret drops the owner's claim on the secret, deleting it if no owners remain. Otherwise the owner's keys
+// are removed, and a combined secret kind is narrowed to the kind of the remaining owners.
+// Secrets we don't manage, or which are not owned by the owner, are left alone.
+func releaseSecret(ctx context.Context, c client.Client, owner client.Object, secretName, kind string, keys ...string) error {
+	logger := log.FromContext(ctx).WithValues("secret", secretName)
+
+	secret := &core_v1.Secret{}
+	err := c.Get(ctx, types.NamespacedName{Name: secretName, Namespace: owner.GetNamespace()}, secret)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return temporaryFailureError(fmt.Errorf("failed to get secret: %w", err))
+	}
+
+	ownerReference, err := ownerReferenceFor(c.Scheme(), owner)
+	if err != nil {
+		return err
+	}
+	owned := slices.ContainsFunc(ownerReferencesOf(secret), func(existing meta_v1.OwnerReference) bool {
+		return existing.APIVersion == ownerReference.APIVersion && existing.Kind == ownerReference.Kind && existing.Name == ownerReference.Name
+	})
+	if !owned || validateOwnership(ownerReference, secret, sharedSecretCoOwners(ownerReference, secret)...) != nil {
+		return nil
+	}
+
+	secret.SetOwnerReferences(removeOwnerReference(secret.GetOwnerReferences(), ownerReference))
+	setAnnotatedOwnerReferences(secret, removeOwnerReference(annotatedOwnerReferences(secret), ownerReference))
+	if len(ownerReferencesOf(secret)) == 0 {
+		if err := c.Delete(ctx, secret); client.IgnoreNotFound(err) != nil {
+			return temporaryFailureError(fmt.Errorf("failed to delete secret: %w", err))
+		}
+		logger.Info("Secret deleted")
+		return nil
+	}
+
+	for _, key := range keys {
+		delete(secret.Data, key)
+		delete(secret.StringData, key)
+	}
+	setManagedKeys(secret, ownerReference, nil)
+	delete(secret.Annotations, ownerAnnotation(ownerReference, sourceGenerationAnnotation))
+	delete(secret.Annotations, ownerAnnotation(ownerReference, managedLabelsAnnotation))
+	// other users sharing the secret still have credentials in it
+	remainingOfKind := slices.ContainsFunc(ownerReferencesOf(secret), func(existing meta_v1.OwnerReference) bool {
+		return existing.Kind == ownerReference.Kind
+	})
+	if ownerReference.Kind == v1beta1.SQLUserGVK.Kind {
+		for _, annotation := range []string{resolvedInstanceAnnotation, passwordKeyAnnotation, serviceAccountAnnotation, serviceAccountLabelAnnotation} {
+			delete(secret.Annotations, ownerAnnotation(ownerReference, annotation))
+			// the last user recorded them without qualifying them
+			if !remainingOfKind {
+				delete(secret.Annotations, annotation)
+			}
+		}
+		if err := setServiceAccountLabel(secret); err != nil {
+			logger.Info("Remaining users ask to label the secret with different service accounts, leaving the label", "error", err)
+		}
+	}
+	if secret.Labels[secretKindKey] == secretKindCombined && !remainingOfKind {
+		switch kind {
+		case secretKindCredentials:
+			secret.Labels[secretKindKey] = secretKindCertificate
+		case secretKindCertificate:
+			secret.Labels[secretKindKey] = secretKindCredentials
+		}
+	}
+	if err := c.Update(ctx, secret); err != nil {
+		return temporaryFailureError(fmt.Errorf("failed to release secret: %w", err))
+	}
+	logger.Info("Secret released to remaining owners")
+	return nil
+}
@@ -1,96 +1,386 @@
 package controller
 
 import (
+	"cmp"
 	"context"
 	"errors"
 	"fmt"
+	"net"
+	"net/netip"
+	"reflect"
 	"slices"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/GoogleCloudPlatform/k8s-config-connector/pkg/clients/generated/apis/sql/v1beta1"
 	"github.com/prometheus/client_golang/prometheus"
+	core_v1 "k8s.io/api/core/v1"
 	netv1 "k8s.io/api/networking/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/utils/ptr"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
-	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/metrics"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
 )
 
 var instanceRequeuesMetric = prometheus.NewCounter(prometheus.CounterOpts{
 	Name: "sqlinstance_requeues",
-	Help: "Number of requeues for SQLInstance",
+	Help: "Deprecated: use sqeletor_reconcile_total{result=\"requeue\"}. Number of requeues for SQLInstance",
 })
 
-var ipTypesToKeep = []string{"PRIMARY", "PRIVATE"}
+const (
+	egressCIDRAnnotation = "sqeletor.nais.io/egress-cidr"
+	// egressPortsAnnotation limits egress to the postgres port and the listed ports or port ranges, like 3307,9000-9100.
+	// Without it, egress to the instance is allowed on all ports.
+	egressPortsAnnotation = "sqeletor.nais.io/egress-ports"
+	// egressCIDRBitsAnnotation widens egress from each ip to the subnet with the given prefix length around it, like
+	// /28, to accommodate the ip changing within a range. Without it, egress is allowed to the host only. A prefix
+	// length applies to the address family it fits, so an instance with both IPv4 and IPv6 ips takes one of each,
+	// like /28,/120. Subnets wider than /24 for IPv4 and /64 for IPv6 are refused.
+	egressCIDRBitsAnnotation = "sqeletor.nais.io/egress-cidr-bits"
+	// publicIPEgressAnnotation also allows egress to the PRIMARY (public) ip, which is left out by default as clients
+	// connect to the private ip. It defaults to true when egressCIDRAnnotation is set, as that only applies to it, and
+	// for instances without a private ip that clients connect to through the auth proxy.
+	publicIPEgressAnnotation = "sqeletor.nais.io/public-ip-egress"
+	// sqlInstanceLabelKey identifies which instance a netpol allows egress to, so that apps using several
+	// instances can list all their policies with `-l app=<app>` and tell them apart.
+	sqlInstanceLabelKey = "sqeletor.nais.io/sqlinstance"
+	// instanceConnectionNameAnnotation holds the project:region:name connection name of the instance a netpol allows
+	// egress to, for tooling correlating netpols with Cloud SQL instances
+	instanceConnectionNameAnnotation = "sqeletor.nais.io/instance-connection-name"
+	// cnrmProjectIDAnnotation is set by Config Connector to the project a resource is created in
+	cnrmProjectIDAnnotation = "cnrm.cloud.google.com/project-id"
+	// pscEndpointAnnotation holds the ip of the Private Service Connect endpoint of the instance in the consumer
+	// network. Config Connector only reports the dns name and service attachment of PSC instances, not the ip
+	pscEndpointAnnotation = "sqeletor.nais.io/psc-endpoint-ip"
+	// splitPublicIPEgressAnnotation allows egress to the PRIMARY (public) ip in a network policy of its own, suffixed
+	// -public, so that it can be reviewed and removed separately from the one allowing egress to the private ips
+	splitPublicIPEgressAnnotation = "sqeletor.nais.io/split-public-ip-egress"
+	// egressScopeLabelKey tells the network policies of a split instance apart, as private or public
+	egressScopeLabelKey = "sqeletor.nais.io/egress-scope"
+)
+
+const (
+	egressScopePrivate = "private"
+	egressScopePublic  = "public"
+)
+
+// uniqueCIDRs returns the cidrs without duplicates, in the order they first appear.
+func uniqueCIDRs(cidrs []string) []string {
+	seen := make(map[string]bool, len(cidrs))
+	unique := make([]string, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if !seen[cidr] {
+			seen[cidr] = true
+			unique = append(unique, cidr)
+		}
+	}
+	return unique
+}
+
+// instanceConnectionName returns the connection name from the status of the instance, or constructs it from the
+// project, region and name of the instance before the status has it. Returns an empty string if neither is known.
+func instanceConnectionName(sqlInstance *v1beta1.SQLInstance) string {
+	if connectionName := ptr.Deref(sqlInstance.Status.ConnectionName, ""); connectionName != "" {
+		return connectionName
+	}
+	project := sqlInstance.Annotations[cnrmProjectIDAnnotation]
+	region := ptr.Deref(sqlInstance.Spec.Region, "")
+	name := ptr.Deref(sqlInstance.Spec.ResourceID, sqlInstance.Name)
+	if project == "" || region == "" {
+		return ""
+	}
+	return project + ":" + region + ":" + name
+}
+
+// DefaultMaxEgressPeers is far more ips than an instance has, so that only a runaway status is truncated
+const DefaultMaxEgressPeers = 16
+
+// instancePublicIPEgress reports whether egress to the PRIMARY (public) ip of the instance is allowed. It is by default
+// for instances without a private ip that clients connect to through the auth proxy, as the proxy connects to the
+// public ip then.
+func instancePublicIPEgress(sqlInstance *v1beta1.SQLInstance) bool {
+	_, hasEgressCIDR := sqlInstance.Annotations[egressCIDRAnnotation]
+	return boolAnnotation(sqlInstance, publicIPEgressAnnotation, hasEgressCIDR || authProxyToPublicIP(sqlInstance))
+}
+
+// authProxyToPublicIP reports whether clients connect through the auth proxy to the public ip of the instance, as it
+// has no private ip.
+func authProxyToPublicIP(sqlInstance *v1beta1.SQLInstance) bool {
+	_, err := instancePrivateIP(sqlInstance)
+	return usesAuthProxy(sqlInstance) && errors.Is(err, errPermanentFailure)
+}
+
+var netpolIPCountMetric = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "sqlinstance_netpol_ip_count",
+	Help: "Number of egress peers in the network policy of each SQLInstance",
+}, []string{"namespace", "instance"})
 
 func init() {
-	metrics.Registry.MustRegister(instanceRequeuesMetric)
+	metrics.Registry.MustRegister(instanceRequeuesMetric, netpolIPCountMetric)
 }
 
 // SQLInstanceReconciler reconciles a SQLInstance object
 type SQLInstanceReconciler struct {
 	client.Client
-	Scheme *runtime.Scheme
+	Scheme        *runtime.Scheme
+	Recorder      record.EventRecorder
+	LabelSelector labels.Selector
+	// StrictOwnership reports managed labels that were changed externally, in addition to resetting them.
+	StrictOwnership bool
+	// ResourceMetricLabels labels the reconcile metrics with the team and app of the resource.
+	ResourceMetricLabels bool
+	// Trigger enqueues reconciles requested through the admin endpoint, if set.
+	Trigger *ReconcileTrigger
+	// MaxEgressPeers caps the number of ips each network policy allows egress to, defaults to DefaultMaxEgressPeers.
+	MaxEgressPeers int
+	// LegacyValidation keeps accepting instances without an app label, as earlier releases did, with a warning event.
+	LegacyValidation bool
 }
 
 func (r *SQLInstanceReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 	logger := log.FromContext(ctx)
+	start := time.Now()
 
-	err := r.reconcile(ctx, req)
+	// filled in by the reconcile, and left empty if the instance is gone
+	sqlInstance := &v1beta1.SQLInstance{}
+	err := r.reconcile(ctx, req, sqlInstance)
+	resource := metricResourceLabels(r.ResourceMetricLabels, sqlInstance)
 	if errors.Is(err, errTemporaryFailure) {
 		instanceRequeuesMetric.Inc()
+		observeRequeue("SQLInstance", err)
+		observeReconcile("SQLInstance", reconcileResultRequeue, start, resource)
 		logger.Error(err, "requeueing after temporary failure")
 		return ctrl.Result{
-			RequeueAfter: time.Minute,
+			RequeueAfter: requeueInterval(ctx, sqlInstance),
 		}, nil
 	}
 	if err != nil {
+		observeReconcile("SQLInstance", reconcileResultError, start, resource)
 		logger.Error(err, "failed to reconcile SQLInstance")
+		return ctrl.Result{}, err
 	}
-	return ctrl.Result{}, err
+	observeReconcile("SQLInstance", reconcileResultSuccess, start, resource)
+	lastSuccessfulReconcileMetric.WithLabelValues("SQLInstance").SetToCurrentTime()
+	return ctrl.Result{}, nil
 }
 
-func (r *SQLInstanceReconciler) reconcile(ctx context.Context, req ctrl.Request) error {
+func (r *SQLInstanceReconciler) reconcile(ctx context.Context, req ctrl.Request, sqlInstance *v1beta1.SQLInstance) error {
 	logger := log.FromContext(ctx)
 
-	sqlInstance := &v1beta1.SQLInstance{}
 	if err := r.Get(ctx, req.NamespacedName, sqlInstance); err != nil {
 		if apierrors.IsNotFound(err) {
 			logger.Info("SQLInstance not found, aborting reconcile")
+			netpolIPCountMetric.DeleteLabelValues(req.Namespace, req.Name)
 			return nil
 		}
 		return temporaryFailureError(fmt.Errorf("failed to get SQLInstance: %w", err))
 	}
 
+	if boolAnnotation(sqlInstance, pausedAnnotation, false) {
+		logger.Info("SQLInstance is paused, leaving network policy untouched", "annotation", pausedAnnotation)
+		return nil
+	}
+
 	if sqlInstance.Spec.ResourceID == nil {
-		logger.Info("SQLInstance has no resource ID, requeueing")
-		return temporaryFailureError(fmt.Errorf("SQLInstance has no resource ID"))
+		r.Recorder.Event(sqlInstance, core_v1.EventTypeWarning, "MissingResourceID", "SQLInstance has no spec.resourceID, unable to name network policy")
+		return permanentFailureError(fmt.Errorf("SQLInstance has no resource ID: spec.resourceID is required"))
+	}
+
+	// the netpol selects pods by the app label, so without it the policy would not apply to the intended pods
+	appName := sqlInstance.Labels[appKey]
+	if appName == "" {
+		if !r.LegacyValidation {
+			r.Recorder.Event(sqlInstance, core_v1.EventTypeWarning, "MissingAppLabel", "SQLInstance has no app label, unable to select pods for network policy")
+			return permanentFailureError(fmt.Errorf("SQLInstance has no %s label", appKey))
+		}
+		r.Recorder.Event(sqlInstance, core_v1.EventTypeWarning, "MissingAppLabel", "SQLInstance has no app label, so its network policy selects no pods. This will be rejected once legacy validation is removed")
+	}
+
+	// the PRIMARY (public) ip may be rotated by Google, so allow the operator to
+	// widen its egress rule to a range. PRIVATE ips are always pinned.
+	egressCIDR, hasEgressCIDR := sqlInstance.Annotations[egressCIDRAnnotation]
+	if hasEgressCIDR {
+		_, ipNet, err := net.ParseCIDR(egressCIDR)
+		if err != nil {
+			r.Recorder.Eventf(sqlInstance, core_v1.EventTypeWarning, "InvalidEgressCIDR", "Annotation %s is not a valid CIDR: %s", egressCIDRAnnotation, egressCIDR)
+			return permanentFailureError(fmt.Errorf("invalid egress CIDR %q: %w", egressCIDR, err))
+		}
+		egressCIDR = ipNet.String()
+	}
+
+	var egressPorts []netv1.NetworkPolicyPort
+	if value, ok := sqlInstance.Annotations[egressPortsAnnotation]; ok {
+		ports, err := parseEgressPorts(value)
+		if err != nil {
+			r.Recorder.Eventf(sqlInstance, core_v1.EventTypeWarning, "InvalidEgressPorts", "Annotation %s is not a valid list of ports: %s", egressPortsAnnotation, value)
+			return permanentFailureError(err)
+		}
+		egressPorts = ports
 	}
 
-	ips := []string{}
+	var egressCIDRBits egressCIDRBits
+	if value, ok := sqlInstance.Annotations[egressCIDRBitsAnnotation]; ok {
+		bits, err := parseEgressCIDRBits(value)
+		if err != nil {
+			r.Recorder.Eventf(sqlInstance, core_v1.EventTypeWarning, "InvalidEgressCIDRBits", "Annotation %s is not valid: %v", egressCIDRBitsAnnotation, err)
+			return permanentFailureError(fmt.Errorf("invalid egress CIDR bits %q: %w", value, err))
+		}
+		egressCIDRBits = bits
+	}
+
+	publicIPEgress := instancePublicIPEgress(sqlInstance)
+	cidrs := []string{}
+	// public ips come after the private ones, to be the first to go if there are too many
+	var publicCIDRs []string
+	hasPublicIP := false
 	for _, ip := range sqlInstance.Status.IpAddress {
-		if ip.IpAddress != nil && slices.Contains(ipTypesToKeep, ptr.Deref(ip.Type, "")) {
-			ips = append(ips, ptr.Deref(ip.IpAddress, ""))
+		ipType := ptr.Deref(ip.Type, "")
+		if ip.IpAddress == nil {
+			continue
+		}
+		if ipType == hostIPTypePrimary {
+			hasPublicIP = true
+			if !publicIPEgress {
+				continue
+			}
+			if hasEgressCIDR {
+				publicCIDRs = append(publicCIDRs, egressCIDR)
+				continue
+			}
+		} else if ipType != hostIPTypePrivate {
+			continue
+		}
+		cidr, err := ipCIDR(*ip.IpAddress, egressCIDRBits.forIP(*ip.IpAddress))
+		if err != nil {
+			r.Recorder.Eventf(sqlInstance, core_v1.EventTypeWarning, "InvalidEgressIP", "Unable to allow egress to %s: %v", *ip.IpAddress, err)
+			return permanentFailureError(err)
+		}
+		if ipType == hostIPTypePrimary {
+			publicCIDRs = append(publicCIDRs, cidr)
+		} else {
+			cidrs = append(cidrs, cidr)
+		}
+	}
+	if pscEndpoint := sqlInstance.Annotations[pscEndpointAnnotation]; pscEndpoint != "" {
+		cidr, err := ipCIDR(pscEndpoint, egressCIDRBits.forIP(pscEndpoint))
+		if err != nil {
+			r.Recorder.Eventf(sqlInstance, core_v1.EventTypeWarning, "InvalidEgressIP", "Unable to allow egress to %s: %v", pscEndpoint, err)
+			return permanentFailureError(err)
+		}
+		cidrs = append(cidrs, cidr)
+	}
+	privateCount := len(uniqueCIDRs(cidrs))
+	cidrs = uniqueCIDRs(append(cidrs, publicCIDRs...))
+
+	maxEgressPeers := r.MaxEgressPeers
+	if maxEgressPeers <= 0 {
+		maxEgressPeers = DefaultMaxEgressPeers
+	}
+	// a split instance is limited per network policy, so that the private ips do not crowd out the public policy
+	splitPublicIPEgress := boolAnnotation(sqlInstance, splitPublicIPEgressAnnotation, false)
+	if !splitPublicIPEgress && len(cidrs) > maxEgressPeers {
+		logger.Info("Instance has more ips than allowed in the network policy, truncating", "count", len(cidrs), "max", maxEgressPeers)
+		r.Recorder.Eventf(sqlInstance, core_v1.EventTypeWarning, "TooManyEgressIPs", "SQLInstance has %d ips, only allowing egress to the first %d", len(cidrs), maxEgressPeers)
+		cidrs = cidrs[:maxEgressPeers]
+	}
+	if len(cidrs) == 0 && instancePSCEnabled(sqlInstance) {
+		r.Recorder.Eventf(sqlInstance, core_v1.EventTypeWarning, "MissingPSCEndpoint", "SQLInstance is only reachable through Private Service Connect, set %s to the ip of its endpoint to allow egress to it", pscEndpointAnnotation)
+		return permanentFailureError(fmt.Errorf("SQLInstance has no private ip, and the ip of its Private Service Connect endpoint is not annotated"))
+	}
+
+	ownerReference, err := ownerReferenceFor(r.Scheme, sqlInstance)
+	if err != nil {
+		return err
+	}
+
+	netpolName := "sql-" + sqlInstance.Name + "-" + *sqlInstance.Spec.ResourceID
+	publicNetpolName := netpolName + "-public"
+	if len(cidrs) == 0 && hasPublicIP {
+		r.Recorder.Eventf(sqlInstance, core_v1.EventTypeWarning, "PublicIPOnly", "SQLInstance only has a public ip, set %s=true to allow egress to it", publicIPEgressAnnotation)
+		// the ips the policies allow egress to are gone, or egress to them is no longer allowed
+		for _, name := range []string{netpolName, publicNetpolName} {
+			if err := r.deleteNetpol(ctx, sqlInstance, ownerReference, name); err != nil {
+				return err
+			}
 		}
+		netpolIPCountMetric.WithLabelValues(sqlInstance.Namespace, sqlInstance.Name).Set(0)
+		return permanentFailureError(fmt.Errorf("SQLInstance only has a public ip, and egress to it is not allowed"))
 	}
-	if len(ips) == 0 {
+	if len(cidrs) == 0 {
 		logger.Info("SQLInstance has no IP address, requeueing")
-		return temporaryFailureError(fmt.Errorf("SQLInstance has no IP address"))
+		return temporaryFailureErrorFor(reasonWaitingForInstanceIP, fmt.Errorf("SQLInstance has no IP address"))
 	}
+	egressPeers := 0
+	if splitPublicIPEgress {
+		policies := []struct {
+			name, scope string
+			cidrs       []string
+		}{
+			{netpolName, egressScopePrivate, cidrs[:privateCount]},
+			{publicNetpolName, egressScopePublic, cidrs[privateCount:]},
+		}
+		for _, policy := range policies {
+			if len(policy.cidrs) == 0 {
+				if err := r.deleteNetpol(ctx, sqlInstance, ownerReference, policy.name); err != nil {
+					return err
+				}
+				continue
+			}
+			if len(policy.cidrs) > maxEgressPeers {
+				logger.Info("Instance has more ips than allowed in the network policy, truncating", "netpol", policy.name, "count", len(policy.cidrs), "max", maxEgressPeers)
+				r.Recorder.Eventf(sqlInstance, core_v1.EventTypeWarning, "TooManyEgressIPs", "SQLInstance has %d %s ips, only allowing egress to the first %d in network policy %s", len(policy.cidrs), policy.scope, maxEgressPeers, policy.name)
+				policy.cidrs = policy.cidrs[:maxEgressPeers]
+			}
+			peers, err := r.reconcileNetpol(ctx, sqlInstance, ownerReference, policy.name, appName, policy.scope, policy.cidrs, egressPorts)
+			if err != nil {
+				return err
+			}
+			egressPeers += peers
+		}
+	} else {
+		peers, err := r.reconcileNetpol(ctx, sqlInstance, ownerReference, netpolName, appName, "", cidrs, egressPorts)
+		if err != nil {
+			return err
+		}
+		egressPeers += peers
+		if err := r.deleteNetpol(ctx, sqlInstance, ownerReference, publicNetpolName); err != nil {
+			return err
+		}
+	}
+	netpolIPCountMetric.WithLabelValues(sqlInstance.Namespace, sqlInstance.Name).Set(float64(egressPeers))
+
+	return r.reconcilePodMonitor(ctx, sqlInstance, netpolName, appName)
+}
+
+// reconcileNetpol allows egress from the pods of the app to the cidrs, returning the number of egress peers. The
+// network policies of a split instance are labeled with their egress scope.
+func (r *SQLInstanceReconciler) reconcileNetpol(ctx context.Context, sqlInstance *v1beta1.SQLInstance, ownerReference meta_v1.OwnerReference, name, appName, scope string, cidrs []string, egressPorts []netv1.NetworkPolicyPort) (int, error) {
+	logger := log.FromContext(ctx).WithValues("netpol", name)
 
 	netpol := &netv1.NetworkPolicy{
 		ObjectMeta: meta_v1.ObjectMeta{
-			Name:      "sql-" + sqlInstance.Name + "-" + *sqlInstance.Spec.ResourceID,
+			Name:      name,
 			Namespace: sqlInstance.Namespace,
 		},
 	}
 
-	op, err := controllerutil.CreateOrUpdate(ctx, r.Client, netpol, func() error {
+	var driftedLabels []string
+	op, err := createOrUpdate(ctx, r.Client, netpol, func() error {
+		driftedLabels = nil
+		isNew := netpol.CreationTimestamp.IsZero()
 		if netpol.Labels == nil {
 			netpol.Labels = make(map[string]string)
 		}
@@ -98,64 +388,264 @@ func (r *SQLInstanceReconciler) reconcile(ctx context.Context, req ctrl.Request)
 			netpol.Annotations = make(map[string]string)
 		}
 
-		ownerReference := meta_v1.OwnerReference{
-			APIVersion: sqlInstance.GetObjectKind().GroupVersionKind().GroupVersion().String(),
-			Kind:       sqlInstance.GetObjectKind().GroupVersionKind().Kind,
-			Name:       sqlInstance.GetName(),
-			UID:        sqlInstance.GetUID(),
-		}
-
 		// if new resource, add owner reference and managed-by label
 		// the netpol is owned by the sql instance.
-		if netpol.CreationTimestamp.IsZero() {
+		if isNew {
 			netpol.OwnerReferences = []meta_v1.OwnerReference{ownerReference}
 			netpol.Labels[managedByKey] = sqeletorFqdnId
 		} else if err := validateOwnership(ownerReference, netpol); err != nil {
 			return err
 		}
+		// upgrades owner references written before they were marked as controller
+		ensureOwnerReference(ownerReference, netpol)
 
-		netpol.Labels[typeKey] = sqeletorFqdnId
-		netpol.Labels[appKey] = sqlInstance.Labels[appKey]
-		netpol.Labels[teamKey] = sqlInstance.Labels[teamKey]
+		drifted := setManagedLabels(netpol, map[string]string{
+			typeKey:             sqeletorFqdnId,
+			appKey:              appName,
+			sqlInstanceLabelKey: sqlInstance.Name,
+			teamKey:             sqlInstance.Labels[teamKey],
+		})
+		if !isNew {
+			driftedLabels = drifted
+		}
+		if scope != "" {
+			netpol.Labels[egressScopeLabelKey] = scope
+		} else {
+			delete(netpol.Labels, egressScopeLabelKey)
+		}
 
 		netpol.Annotations[deploymentCorrelationIdKey] = sqlInstance.Annotations[deploymentCorrelationIdKey]
+		if connectionName := instanceConnectionName(sqlInstance); connectionName != "" {
+			netpol.Annotations[instanceConnectionNameAnnotation] = connectionName
+		} else {
+			delete(netpol.Annotations, instanceConnectionNameAnnotation)
+		}
 
 		netpol.Spec.PodSelector = meta_v1.LabelSelector{
 			MatchLabels: map[string]string{
-				appKey: sqlInstance.Labels[appKey],
+				appKey: appName,
 			},
 		}
 
 		netpol.Spec.PolicyTypes = []netv1.PolicyType{netv1.PolicyTypeEgress}
 		netpol.Spec.Egress = []netv1.NetworkPolicyEgressRule{}
-		slices.Sort(ips)
-		for _, ip := range ips {
+		slices.SortFunc(cidrs, compareCIDRs)
+		for _, cidr := range slices.Compact(cidrs) {
 			netpol.Spec.Egress = append(netpol.Spec.Egress, netv1.NetworkPolicyEgressRule{
 				To: []netv1.NetworkPolicyPeer{
 					{
 						IPBlock: &netv1.IPBlock{
-							CIDR: ip + "/32",
+							CIDR: cidr,
 						},
 					},
 				},
+				Ports: egressPorts,
 			})
 		}
 
 		return nil
 	})
+	// without the NetworkPolicy API, retrying would only hot-loop
+	if meta.IsNoMatchError(err) || runtime.IsNotRegisteredError(err) {
+		r.Recorder.Event(sqlInstance, core_v1.EventTypeWarning, "NetworkPolicyUnavailable", "NetworkPolicy API is not available in the cluster, unable to allow egress to instance")
+		return 0, permanentFailureError(fmt.Errorf("NetworkPolicy API unavailable: %w", err))
+	}
 	if err != nil {
 		if errors.Is(err, errPermanentFailure) {
-			return err
+			return 0, err
 		}
-		return temporaryFailureError(err)
+		return 0, temporaryFailureError(err)
+	}
+
+	if r.StrictOwnership && len(driftedLabels) > 0 {
+		reportLabelDrift(ctx, r.Recorder, sqlInstance, netpol, driftedLabels)
 	}
 
 	logger.Info("Netpol reconciled", "operation", op)
+	return len(netpol.Spec.Egress), nil
+}
+
+// deleteNetpol deletes the named network policy of the instance, if it exists and is ours.
+func (r *SQLInstanceReconciler) deleteNetpol(ctx context.Context, sqlInstance *v1beta1.SQLInstance, ownerReference meta_v1.OwnerReference, name string) error {
+	netpol := &netv1.NetworkPolicy{}
+	err := r.Get(ctx, types.NamespacedName{Name: name, Namespace: sqlInstance.Namespace}, netpol)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return temporaryFailureError(fmt.Errorf("failed to get network policy %s: %w", name, err))
+	}
+	if validateOwnership(ownerReference, netpol) != nil {
+		return nil
+	}
+	if err := r.Delete(ctx, netpol); client.IgnoreNotFound(err) != nil {
+		return temporaryFailureError(fmt.Errorf("failed to delete network policy %s: %w", name, err))
+	}
+	log.FromContext(ctx).Info("Netpol deleted", "netpol", name)
 	return nil
 }
 
+// parseEgressPorts parses a comma separated list of ports and port ranges, returning them as TCP ports following
+// the postgres port.
+func parseEgressPorts(value string) ([]netv1.NetworkPolicyPort, error) {
+	ports := []netv1.NetworkPolicyPort{{
+		Protocol: ptr.To(core_v1.ProtocolTCP),
+		Port:     ptr.To(intstr.FromInt32(postgresPortNumber)),
+	}}
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		start, end, isRange := strings.Cut(field, "-")
+		port, err := parsePort(start)
+		if err != nil {
+			return nil, fmt.Errorf("invalid egress port %q: %w", field, err)
+		}
+		policyPort := netv1.NetworkPolicyPort{
+			Protocol: ptr.To(core_v1.ProtocolTCP),
+			Port:     ptr.To(intstr.FromInt32(port)),
+		}
+		if isRange {
+			endPort, err := parsePort(end)
+			if err != nil {
+				return nil, fmt.Errorf("invalid egress port range %q: %w", field, err)
+			}
+			if endPort < port {
+				return nil, fmt.Errorf("invalid egress port range %q: end is before start", field)
+			}
+			policyPort.EndPort = ptr.To(endPort)
+		}
+		ports = append(ports, policyPort)
+	}
+	return ports, nil
+}
+
+// parsePort parses a port number, which must be between 1 and 65535.
+func parsePort(value string) (int32, error) {
+	port, err := strconv.ParseInt(value, 10, 32)
+	if err != nil {
+		return 0, err
+	}
+	if port < 1 || port > 65535 {
+		return 0, fmt.Errorf("port %d is out of range", port)
+	}
+	return int32(port), nil
+}
+
+// minEgressCIDRBitsIPv4 and minEgressCIDRBitsIPv6 are the shortest prefix lengths egress may be widened to, so that a
+// typo like /2 doesn't open egress to a large part of the network
+const (
+	minEgressCIDRBitsIPv4 = 24
+	minEgressCIDRBitsIPv6 = 64
+)
+
+// egressCIDRBits holds the prefix lengths egress is widened to per address family, 0 for the host only.
+type egressCIDRBits struct {
+	ipv4, ipv6 int
+}
+
+// parseEgressCIDRBits parses a comma separated list of prefix lengths like /28,/120, telling the address family of
+// each by its length: one that fits IPv4 applies to the IPv4 ips, a longer one to the IPv6 ips.
+func parseEgressCIDRBits(value string) (egressCIDRBits, error) {
+	var bits egressCIDRBits
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		n, err := strconv.Atoi(strings.TrimPrefix(field, "/"))
+		if err != nil {
+			return egressCIDRBits{}, fmt.Errorf("invalid prefix length %q", field)
+		}
+		family, familyBits := "IPv4", &bits.ipv4
+		switch {
+		case n >= minEgressCIDRBitsIPv4 && n <= 32:
+		case n >= minEgressCIDRBitsIPv6 && n <= 128:
+			family, familyBits = "IPv6", &bits.ipv6
+		default:
+			return egressCIDRBits{}, fmt.Errorf("prefix length %q is neither an IPv4 prefix length of /%d to /32 nor an IPv6 prefix length of /%d to /128", field, minEgressCIDRBitsIPv4, minEgressCIDRBitsIPv6)
+		}
+		if *familyBits != 0 {
+			return egressCIDRBits{}, fmt.Errorf("more than one %s prefix length", family)
+		}
+		*familyBits = n
+	}
+	return bits, nil
+}
+
+// forIP returns the prefix length for the address family of the ip, 0 if it doesn't parse, leaving that to ipCIDR.
+func (b egressCIDRBits) forIP(ip string) int {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return 0
+	}
+	if addr.Is4() {
+		return b.ipv4
+	}
+	return b.ipv6
+}
+
+// ipCIDR returns the cidr of the subnet with the given prefix length around the ip, or of the ip alone if bits is 0.
+func ipCIDR(ip string, bits int) (string, error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return "", fmt.Errorf("invalid ip address %q: %w", ip, err)
+	}
+	if bits == 0 {
+		bits = addr.BitLen()
+	}
+	if bits > addr.BitLen() {
+		return "", fmt.Errorf("prefix length %d is longer than the %d bits of ip address %s", bits, addr.BitLen(), ip)
+	}
+	minBits := minEgressCIDRBitsIPv4
+	if addr.Is6() {
+		minBits = minEgressCIDRBitsIPv6
+	}
+	if bits < minBits {
+		return "", fmt.Errorf("prefix length %d is shorter than the minimum of %d for ip address %s", bits, minBits, ip)
+	}
+	prefix, err := addr.Prefix(bits)
+	if err != nil {
+		return "", err
+	}
+	return prefix.String(), nil
+}
+
+// compareCIDRs orders cidrs by address and then prefix length, where sorting them as strings would put e.g.
+// 10.10.10.10/32 before 10.2.2.2/32. Cidrs that don't parse sort last, as strings.
+func compareCIDRs(a, b string) int {
+	prefixA, errA := netip.ParsePrefix(a)
+	prefixB, errB := netip.ParsePrefix(b)
+	switch {
+	case errA != nil && errB != nil:
+		return strings.Compare(a, b)
+	case errA != nil:
+		return 1
+	case errB != nil:
+		return -1
+	}
+	if c := prefixA.Addr().Compare(prefixB.Addr()); c != 0 {
+		return c
+	}
+	return cmp.Compare(prefixA.Bits(), prefixB.Bits())
+}
+
 func (r *SQLInstanceReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	return ctrl.NewControllerManagedBy(mgr).
-		For(&v1beta1.SQLInstance{}).
-		Complete(r)
+	b := ctrl.NewControllerManagedBy(mgr).
+		For(&v1beta1.SQLInstance{}, builder.WithPredicates(labelSelectorPredicate(r.LabelSelector), relevantChangePredicate(instanceIPChangedPredicate())))
+	return watchTriggered(b, r.Trigger, v1beta1.SQLInstanceGVK, r.LabelSelector).Complete(r)
+}
+
+// instanceIPChangedPredicate passes updates changing the ip addresses in the status, which the network policy allows,
+// or the connection name it is annotated with.
+func instanceIPChangedPredicate() predicate.Predicate {
+	return predicate.Funcs{
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			oldInstance, ok := e.ObjectOld.(*v1beta1.SQLInstance)
+			if !ok {
+				return false
+			}
+			newInstance, ok := e.ObjectNew.(*v1beta1.SQLInstance)
+			if !ok {
+				return false
+			}
+			return !reflect.DeepEqual(oldInstance.Status.IpAddress, newInstance.Status.IpAddress) ||
+				ptr.Deref(oldInstance.Status.ConnectionName, "") != ptr.Deref(newInstance.Status.ConnectionName, "")
+		},
+	}
 }
@@ -2,20 +2,27 @@ package controller
 
 import (
 	"context"
+	"fmt"
+	"slices"
 	"time"
 
 	"github.com/GoogleCloudPlatform/k8s-config-connector/pkg/clients/generated/apis/sql/v1beta1"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 
-	// core_v1 "k8s.io/api/core/v1"
+	core_v1 "k8s.io/api/core/v1"
 	v1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
-
-	//"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/intstr"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/utils/ptr"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
@@ -31,11 +38,638 @@ var _ = Describe("SQLInstance Controller", func() {
 		var clientBuilder *fake.ClientBuilder
 		var k8sClient client.Client
 		var controller *SQLInstanceReconciler
+		var recorder *record.FakeRecorder
 
 		BeforeEach(func() {
 			utilruntime.Must(v1beta1.AddToScheme(scheme.Scheme))
 			clientBuilder = fake.NewClientBuilder().
 				WithScheme(scheme.Scheme)
+			recorder = record.NewFakeRecorder(10)
+		})
+
+		When("the resource has no resource ID", func() {
+			BeforeEach(func() {
+				existingSQLInstance := &v1beta1.SQLInstance{
+					TypeMeta: meta_v1.TypeMeta{
+						APIVersion: "sql.cnrm.cloud.google.com/v1beta1",
+						Kind:       "SQLInstance",
+					},
+					ObjectMeta: meta_v1.ObjectMeta{
+						Name:      instanceIdentifier.Name,
+						Namespace: instanceIdentifier.Namespace,
+					},
+					Status: v1beta1.SQLInstanceStatus{
+						IpAddress: []v1beta1.InstanceIpAddressStatus{
+							{
+								IpAddress: ptr.To("10.10.10.10"),
+								Type:      ptr.To("PRIVATE"),
+							},
+						},
+					},
+				}
+				k8sClient = clientBuilder.WithObjects(existingSQLInstance).Build()
+				controller = &SQLInstanceReconciler{Scheme: scheme.Scheme, Client: k8sClient, Recorder: recorder}
+			})
+
+			It("should return a permanent error and emit a warning event", func() {
+				req := ctrl.Request{NamespacedName: instanceIdentifier}
+				_, err := controller.Reconcile(ctx, req)
+				Expect(err).To(MatchError(errPermanentFailure))
+				Expect(err).To(MatchError(ContainSubstring("spec.resourceID is required")))
+
+				Expect(recorder.Events).To(Receive(HavePrefix("Warning MissingResourceID")))
+			})
+
+			It("should not update the last success timestamp", func() {
+				lastSuccessfulReconcileMetric.WithLabelValues("SQLInstance").Set(0)
+
+				req := ctrl.Request{NamespacedName: instanceIdentifier}
+				_, err := controller.Reconcile(ctx, req)
+				Expect(err).To(HaveOccurred())
+
+				Expect(testutil.ToFloat64(lastSuccessfulReconcileMetric.WithLabelValues("SQLInstance"))).To(BeZero())
+			})
+		})
+
+		When("the resource has no app label", func() {
+			BeforeEach(func() {
+				existingSQLInstance := &v1beta1.SQLInstance{
+					TypeMeta: meta_v1.TypeMeta{
+						APIVersion: "sql.cnrm.cloud.google.com/v1beta1",
+						Kind:       "SQLInstance",
+					},
+					ObjectMeta: meta_v1.ObjectMeta{
+						Name:      instanceIdentifier.Name,
+						Namespace: instanceIdentifier.Namespace,
+					},
+					Spec: v1beta1.SQLInstanceSpec{
+						ResourceID: ptr.To("resource-id"),
+					},
+					Status: v1beta1.SQLInstanceStatus{
+						IpAddress: []v1beta1.InstanceIpAddressStatus{
+							{
+								IpAddress: ptr.To("10.10.10.10"),
+								Type:      ptr.To("PRIVATE"),
+							},
+						},
+					},
+				}
+				k8sClient = clientBuilder.WithObjects(existingSQLInstance).Build()
+				controller = &SQLInstanceReconciler{Scheme: scheme.Scheme, Client: k8sClient, Recorder: recorder}
+			})
+
+			It("should return a permanent error, emit a warning event and not create a network policy", func() {
+				req := ctrl.Request{NamespacedName: instanceIdentifier}
+				_, err := controller.Reconcile(ctx, req)
+				Expect(err).To(MatchError(errPermanentFailure))
+
+				Expect(recorder.Events).To(Receive(HavePrefix("Warning MissingAppLabel")))
+
+				netpol := &v1.NetworkPolicy{}
+				err = k8sClient.Get(ctx, netpolIdentifier, netpol)
+				Expect(apierrors.IsNotFound(err)).To(BeTrue())
+			})
+
+			It("should still create the network policy with a warning event under legacy validation", func() {
+				controller.LegacyValidation = true
+				req := ctrl.Request{NamespacedName: instanceIdentifier}
+				_, err := controller.Reconcile(ctx, req)
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(recorder.Events).To(Receive(HavePrefix("Warning MissingAppLabel")))
+				Expect(k8sClient.Get(ctx, netpolIdentifier, &v1.NetworkPolicy{})).To(Succeed())
+			})
+		})
+
+		When("an app uses several instances", func() {
+			BeforeEach(func() {
+				for i, name := range []string{"first-instance", "second-instance"} {
+					existingSQLInstance := &v1beta1.SQLInstance{
+						TypeMeta: meta_v1.TypeMeta{
+							APIVersion: "sql.cnrm.cloud.google.com/v1beta1",
+							Kind:       "SQLInstance",
+						},
+						ObjectMeta: meta_v1.ObjectMeta{
+							Name:      name,
+							Namespace: instanceIdentifier.Namespace,
+							Labels: map[string]string{
+								appKey: "test-app",
+							},
+						},
+						Spec: v1beta1.SQLInstanceSpec{
+							ResourceID: ptr.To(name),
+						},
+						Status: v1beta1.SQLInstanceStatus{
+							IpAddress: []v1beta1.InstanceIpAddressStatus{
+								{
+									IpAddress: ptr.To(fmt.Sprintf("10.10.10.%d", i+1)),
+									Type:      ptr.To("PRIVATE"),
+								},
+							},
+						},
+					}
+					clientBuilder = clientBuilder.WithObjects(existingSQLInstance)
+				}
+				k8sClient = clientBuilder.Build()
+				controller = &SQLInstanceReconciler{Scheme: scheme.Scheme, Client: k8sClient, Recorder: recorder}
+			})
+
+			It("should make all network policies of the app discoverable by the app label", func() {
+				for _, name := range []string{"first-instance", "second-instance"} {
+					req := ctrl.Request{NamespacedName: types.NamespacedName{Name: name, Namespace: instanceIdentifier.Namespace}}
+					_, err := controller.Reconcile(ctx, req)
+					Expect(err).ToNot(HaveOccurred())
+				}
+
+				netpols := &v1.NetworkPolicyList{}
+				err := k8sClient.List(ctx, netpols, client.InNamespace(instanceIdentifier.Namespace), client.MatchingLabels{appKey: "test-app", typeKey: sqeletorFqdnId})
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(netpols.Items).To(HaveLen(2))
+				Expect(netpols.Items).To(ContainElement(HaveField("ObjectMeta.Labels", HaveKeyWithValue(sqlInstanceLabelKey, "first-instance"))))
+				Expect(netpols.Items).To(ContainElement(HaveField("ObjectMeta.Labels", HaveKeyWithValue(sqlInstanceLabelKey, "second-instance"))))
+			})
+		})
+
+		When("the resource has an egress CIDR annotation", func() {
+			var egressCIDR string
+
+			JustBeforeEach(func() {
+				existingSQLInstance := &v1beta1.SQLInstance{
+					TypeMeta: meta_v1.TypeMeta{
+						APIVersion: "sql.cnrm.cloud.google.com/v1beta1",
+						Kind:       "SQLInstance",
+					},
+					ObjectMeta: meta_v1.ObjectMeta{
+						Name:      instanceIdentifier.Name,
+						Namespace: instanceIdentifier.Namespace,
+						Labels: map[string]string{
+							appKey: "test-app",
+						},
+						Annotations: map[string]string{
+							egressCIDRAnnotation: egressCIDR,
+						},
+					},
+					Spec: v1beta1.SQLInstanceSpec{
+						ResourceID: ptr.To("resource-id"),
+					},
+					Status: v1beta1.SQLInstanceStatus{
+						IpAddress: []v1beta1.InstanceIpAddressStatus{
+							{
+								IpAddress: ptr.To("35.35.35.35"),
+								Type:      ptr.To("PRIMARY"),
+							},
+							{
+								IpAddress: ptr.To("10.10.10.10"),
+								Type:      ptr.To("PRIVATE"),
+							},
+						},
+					},
+				}
+				k8sClient = clientBuilder.WithObjects(existingSQLInstance).Build()
+				controller = &SQLInstanceReconciler{Scheme: scheme.Scheme, Client: k8sClient, Recorder: recorder}
+			})
+
+			When("the CIDR is valid", func() {
+				BeforeEach(func() {
+					egressCIDR = "35.35.0.0/16"
+				})
+
+				It("should use the CIDR for the primary ip and keep the private ip pinned", func() {
+					req := ctrl.Request{NamespacedName: instanceIdentifier}
+					_, err := controller.Reconcile(ctx, req)
+					Expect(err).ToNot(HaveOccurred())
+
+					netpol := &v1.NetworkPolicy{}
+					err = k8sClient.Get(ctx, netpolIdentifier, netpol)
+					Expect(err).ToNot(HaveOccurred())
+
+					Expect(netpol.Spec.Egress).To(HaveExactElements([]v1.NetworkPolicyEgressRule{
+						{
+							To: []v1.NetworkPolicyPeer{
+								{
+									IPBlock: &v1.IPBlock{
+										CIDR: "10.10.10.10/32",
+									},
+								},
+							},
+						},
+						{
+							To: []v1.NetworkPolicyPeer{
+								{
+									IPBlock: &v1.IPBlock{
+										CIDR: "35.35.0.0/16",
+									},
+								},
+							},
+						},
+					}))
+				})
+			})
+
+			When("the CIDR is invalid", func() {
+				BeforeEach(func() {
+					egressCIDR = "35.35.0.0/33"
+				})
+
+				It("should return a permanent error and emit a warning event", func() {
+					req := ctrl.Request{NamespacedName: instanceIdentifier}
+					_, err := controller.Reconcile(ctx, req)
+					Expect(err).To(MatchError(errPermanentFailure))
+
+					Expect(recorder.Events).To(Receive(HavePrefix("Warning InvalidEgressCIDR")))
+				})
+			})
+		})
+
+		When("the resource has both private and psc endpoints", func() {
+			BeforeEach(func() {
+				existingSQLInstance := &v1beta1.SQLInstance{
+					TypeMeta: meta_v1.TypeMeta{
+						APIVersion: "sql.cnrm.cloud.google.com/v1beta1",
+						Kind:       "SQLInstance",
+					},
+					ObjectMeta: meta_v1.ObjectMeta{
+						Name:      instanceIdentifier.Name,
+						Namespace: instanceIdentifier.Namespace,
+						Labels: map[string]string{
+							appKey: "test-app",
+						},
+						Annotations: map[string]string{
+							pscEndpointAnnotation: "10.20.20.20",
+						},
+					},
+					Spec: v1beta1.SQLInstanceSpec{
+						ResourceID: ptr.To("resource-id"),
+						Settings: v1beta1.InstanceSettings{
+							IpConfiguration: &v1beta1.InstanceIpConfiguration{
+								PscConfig: []v1beta1.InstancePscConfig{{PscEnabled: ptr.To(true)}},
+							},
+						},
+					},
+					Status: v1beta1.SQLInstanceStatus{
+						DnsName:                  ptr.To("1a2b3c4d5e6f.abcd1234.europe-north1.sql.goog."),
+						PscServiceAttachmentLink: ptr.To("projects/p-tenant/regions/europe-north1/serviceAttachments/a-1a2b3c4d5e6f-psc-service-attachment-abcd"),
+						IpAddress: []v1beta1.InstanceIpAddressStatus{
+							{
+								IpAddress: ptr.To("10.10.10.10"),
+								Type:      ptr.To("PRIVATE"),
+							},
+						},
+					},
+				}
+				k8sClient = clientBuilder.WithObjects(existingSQLInstance).Build()
+				controller = &SQLInstanceReconciler{Scheme: scheme.Scheme, Client: k8sClient, Recorder: recorder}
+			})
+
+			It("should allow egress to both endpoints", func() {
+				req := ctrl.Request{NamespacedName: instanceIdentifier}
+				_, err := controller.Reconcile(ctx, req)
+				Expect(err).ToNot(HaveOccurred())
+
+				netpol := &v1.NetworkPolicy{}
+				err = k8sClient.Get(ctx, netpolIdentifier, netpol)
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(netpol.Spec.Egress).To(HaveExactElements([]v1.NetworkPolicyEgressRule{
+					{To: []v1.NetworkPolicyPeer{{IPBlock: &v1.IPBlock{CIDR: "10.10.10.10/32"}}}},
+					{To: []v1.NetworkPolicyPeer{{IPBlock: &v1.IPBlock{CIDR: "10.20.20.20/32"}}}},
+				}))
+			})
+
+			It("should allow egress to the masked subnet around each endpoint", func() {
+				instance := &v1beta1.SQLInstance{}
+				Expect(k8sClient.Get(ctx, instanceIdentifier, instance)).To(Succeed())
+				meta_v1.SetMetaDataAnnotation(&instance.ObjectMeta, egressCIDRBitsAnnotation, "/28")
+				Expect(k8sClient.Update(ctx, instance)).To(Succeed())
+
+				req := ctrl.Request{NamespacedName: instanceIdentifier}
+				_, err := controller.Reconcile(ctx, req)
+				Expect(err).ToNot(HaveOccurred())
+
+				netpol := &v1.NetworkPolicy{}
+				Expect(k8sClient.Get(ctx, netpolIdentifier, netpol)).To(Succeed())
+				Expect(netpol.Spec.Egress).To(HaveExactElements(
+					HaveField("To", ConsistOf(HaveField("IPBlock.CIDR", "10.10.10.0/28"))),
+					HaveField("To", ConsistOf(HaveField("IPBlock.CIDR", "10.20.20.16/28"))),
+				))
+			})
+
+			It("should widen each address family by its own prefix length", func() {
+				instance := &v1beta1.SQLInstance{}
+				Expect(k8sClient.Get(ctx, instanceIdentifier, instance)).To(Succeed())
+				meta_v1.SetMetaDataAnnotation(&instance.ObjectMeta, pscEndpointAnnotation, "2001:db8::1")
+				meta_v1.SetMetaDataAnnotation(&instance.ObjectMeta, egressCIDRBitsAnnotation, "/28,/120")
+				Expect(k8sClient.Update(ctx, instance)).To(Succeed())
+
+				req := ctrl.Request{NamespacedName: instanceIdentifier}
+				_, err := controller.Reconcile(ctx, req)
+				Expect(err).ToNot(HaveOccurred())
+
+				netpol := &v1.NetworkPolicy{}
+				Expect(k8sClient.Get(ctx, netpolIdentifier, netpol)).To(Succeed())
+				Expect(netpol.Spec.Egress).To(HaveExactElements(
+					HaveField("To", ConsistOf(HaveField("IPBlock.CIDR", "10.10.10.0/28"))),
+					HaveField("To", ConsistOf(HaveField("IPBlock.CIDR", "2001:db8::/120"))),
+				))
+
+				// a prefix length for one family leaves the ips of the other pinned
+				Expect(k8sClient.Get(ctx, instanceIdentifier, instance)).To(Succeed())
+				meta_v1.SetMetaDataAnnotation(&instance.ObjectMeta, egressCIDRBitsAnnotation, "/28")
+				Expect(k8sClient.Update(ctx, instance)).To(Succeed())
+				_, err = controller.Reconcile(ctx, req)
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(k8sClient.Get(ctx, netpolIdentifier, netpol)).To(Succeed())
+				Expect(netpol.Spec.Egress).To(HaveExactElements(
+					HaveField("To", ConsistOf(HaveField("IPBlock.CIDR", "10.10.10.0/28"))),
+					HaveField("To", ConsistOf(HaveField("IPBlock.CIDR", "2001:db8::1/128"))),
+				))
+			})
+
+			It("should reject invalid prefix lengths", func() {
+				for _, bits := range []string{"abc", "0", "/-1", "/2", "/33", "/129", "/28,/26", "/28,"} {
+					instance := &v1beta1.SQLInstance{}
+					Expect(k8sClient.Get(ctx, instanceIdentifier, instance)).To(Succeed())
+					meta_v1.SetMetaDataAnnotation(&instance.ObjectMeta, egressCIDRBitsAnnotation, bits)
+					Expect(k8sClient.Update(ctx, instance)).To(Succeed())
+
+					req := ctrl.Request{NamespacedName: instanceIdentifier}
+					_, err := controller.Reconcile(ctx, req)
+					Expect(err).To(MatchError(errPermanentFailure), bits)
+				}
+			})
+
+			It("should order the endpoints by address rather than as strings", func() {
+				instance := &v1beta1.SQLInstance{}
+				Expect(k8sClient.Get(ctx, instanceIdentifier, instance)).To(Succeed())
+				meta_v1.SetMetaDataAnnotation(&instance.ObjectMeta, pscEndpointAnnotation, "9.9.9.9")
+				Expect(k8sClient.Update(ctx, instance)).To(Succeed())
+
+				req := ctrl.Request{NamespacedName: instanceIdentifier}
+				_, err := controller.Reconcile(ctx, req)
+				Expect(err).ToNot(HaveOccurred())
+
+				netpol := &v1.NetworkPolicy{}
+				Expect(k8sClient.Get(ctx, netpolIdentifier, netpol)).To(Succeed())
+				Expect(netpol.Spec.Egress).To(HaveExactElements(
+					HaveField("To", ConsistOf(HaveField("IPBlock.CIDR", "9.9.9.9/32"))),
+					HaveField("To", ConsistOf(HaveField("IPBlock.CIDR", "10.10.10.10/32"))),
+				))
+			})
+
+			It("should refuse a psc only instance until the endpoint ip is annotated", func() {
+				instance := &v1beta1.SQLInstance{}
+				Expect(k8sClient.Get(ctx, instanceIdentifier, instance)).To(Succeed())
+				delete(instance.Annotations, pscEndpointAnnotation)
+				instance.Status.IpAddress = nil
+				Expect(k8sClient.Update(ctx, instance)).To(Succeed())
+
+				req := ctrl.Request{NamespacedName: instanceIdentifier}
+				_, err := controller.Reconcile(ctx, req)
+				Expect(err).To(MatchError(errPermanentFailure))
+				Expect(recorder.Events).To(Receive(HavePrefix("Warning MissingPSCEndpoint")))
+
+				Expect(k8sClient.Get(ctx, instanceIdentifier, instance)).To(Succeed())
+				meta_v1.SetMetaDataAnnotation(&instance.ObjectMeta, pscEndpointAnnotation, "10.20.20.20")
+				Expect(k8sClient.Update(ctx, instance)).To(Succeed())
+				_, err = controller.Reconcile(ctx, req)
+				Expect(err).ToNot(HaveOccurred())
+
+				netpol := &v1.NetworkPolicy{}
+				Expect(k8sClient.Get(ctx, netpolIdentifier, netpol)).To(Succeed())
+				Expect(netpol.Spec.Egress).To(HaveExactElements(
+					HaveField("To", ConsistOf(HaveField("IPBlock.CIDR", "10.20.20.20/32"))),
+				))
+			})
+		})
+
+		When("the status has more ips than allowed", func() {
+			BeforeEach(func() {
+				var ips []v1beta1.InstanceIpAddressStatus
+				for i := 1; i <= 10; i++ {
+					ips = append(ips, v1beta1.InstanceIpAddressStatus{IpAddress: ptr.To(fmt.Sprintf("35.0.0.%d", i)), Type: ptr.To("PRIMARY")})
+				}
+				for i := 1; i <= 3; i++ {
+					ips = append(ips, v1beta1.InstanceIpAddressStatus{IpAddress: ptr.To(fmt.Sprintf("10.0.0.%d", i)), Type: ptr.To("PRIVATE")})
+				}
+				existingSQLInstance := &v1beta1.SQLInstance{
+					TypeMeta: meta_v1.TypeMeta{
+						APIVersion: "sql.cnrm.cloud.google.com/v1beta1",
+						Kind:       "SQLInstance",
+					},
+					ObjectMeta: meta_v1.ObjectMeta{
+						Name:      instanceIdentifier.Name,
+						Namespace: instanceIdentifier.Namespace,
+						Labels: map[string]string{
+							appKey: "test-app",
+						},
+						Annotations: map[string]string{
+							publicIPEgressAnnotation: "true",
+						},
+					},
+					Spec: v1beta1.SQLInstanceSpec{
+						ResourceID: ptr.To("resource-id"),
+					},
+					Status: v1beta1.SQLInstanceStatus{
+						IpAddress: ips,
+					},
+				}
+				k8sClient = clientBuilder.WithObjects(existingSQLInstance).Build()
+				controller = &SQLInstanceReconciler{Scheme: scheme.Scheme, Client: k8sClient, Recorder: recorder, MaxEgressPeers: 4}
+			})
+
+			It("should truncate the egress peers, keeping the private ips, and emit a warning event", func() {
+				req := ctrl.Request{NamespacedName: instanceIdentifier}
+				_, err := controller.Reconcile(ctx, req)
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(recorder.Events).To(Receive(Equal("Warning TooManyEgressIPs SQLInstance has 13 ips, only allowing egress to the first 4")))
+
+				netpol := &v1.NetworkPolicy{}
+				Expect(k8sClient.Get(ctx, netpolIdentifier, netpol)).To(Succeed())
+				Expect(netpol.Spec.Egress).To(HaveExactElements([]v1.NetworkPolicyEgressRule{
+					{To: []v1.NetworkPolicyPeer{{IPBlock: &v1.IPBlock{CIDR: "10.0.0.1/32"}}}},
+					{To: []v1.NetworkPolicyPeer{{IPBlock: &v1.IPBlock{CIDR: "10.0.0.2/32"}}}},
+					{To: []v1.NetworkPolicyPeer{{IPBlock: &v1.IPBlock{CIDR: "10.0.0.3/32"}}}},
+					{To: []v1.NetworkPolicyPeer{{IPBlock: &v1.IPBlock{CIDR: "35.0.0.1/32"}}}},
+				}))
+			})
+
+			It("should truncate each network policy on its own when split", func() {
+				instance := &v1beta1.SQLInstance{}
+				Expect(k8sClient.Get(ctx, instanceIdentifier, instance)).To(Succeed())
+				instance.Annotations[splitPublicIPEgressAnnotation] = "true"
+				Expect(k8sClient.Update(ctx, instance)).To(Succeed())
+
+				req := ctrl.Request{NamespacedName: instanceIdentifier}
+				_, err := controller.Reconcile(ctx, req)
+				Expect(err).ToNot(HaveOccurred())
+
+				publicNetpolIdentifier := types.NamespacedName{Name: netpolIdentifier.Name + "-public", Namespace: netpolIdentifier.Namespace}
+				Expect(drainEvents(recorder)).To(ConsistOf(Equal("Warning TooManyEgressIPs SQLInstance has 10 public ips, only allowing egress to the first 4 in network policy " + publicNetpolIdentifier.Name)))
+
+				netpol := &v1.NetworkPolicy{}
+				Expect(k8sClient.Get(ctx, netpolIdentifier, netpol)).To(Succeed())
+				Expect(netpol.Spec.Egress).To(HaveLen(3))
+
+				publicNetpol := &v1.NetworkPolicy{}
+				Expect(k8sClient.Get(ctx, publicNetpolIdentifier, publicNetpol)).To(Succeed())
+				Expect(publicNetpol.Spec.Egress).To(HaveLen(4))
+				Expect(testutil.ToFloat64(netpolIPCountMetric.WithLabelValues(instanceIdentifier.Namespace, instanceIdentifier.Name))).To(Equal(7.0))
+			})
+		})
+
+		When("the resource asks for a pod monitor", func() {
+			podMonitorIdentifier := netpolIdentifier
+			var existingSQLInstance *v1beta1.SQLInstance
+
+			BeforeEach(func() {
+				existingSQLInstance = &v1beta1.SQLInstance{
+					TypeMeta: meta_v1.TypeMeta{
+						APIVersion: "sql.cnrm.cloud.google.com/v1beta1",
+						Kind:       "SQLInstance",
+					},
+					ObjectMeta: meta_v1.ObjectMeta{
+						Name:      instanceIdentifier.Name,
+						Namespace: instanceIdentifier.Namespace,
+						Labels: map[string]string{
+							appKey: "test-app",
+						},
+						Annotations: map[string]string{
+							createPodMonitorAnnotation: "true",
+						},
+					},
+					Spec: v1beta1.SQLInstanceSpec{
+						ResourceID: ptr.To("resource-id"),
+					},
+					Status: v1beta1.SQLInstanceStatus{
+						IpAddress: []v1beta1.InstanceIpAddressStatus{
+							{
+								IpAddress: ptr.To("10.10.10.10"),
+								Type:      ptr.To("PRIVATE"),
+							},
+						},
+					},
+				}
+			})
+
+			getPodMonitor := func() (*unstructured.Unstructured, error) {
+				podMonitor := &unstructured.Unstructured{}
+				podMonitor.SetGroupVersionKind(podMonitorGVK)
+				return podMonitor, k8sClient.Get(ctx, podMonitorIdentifier, podMonitor)
+			}
+
+			When("the PodMonitor CRD is installed", func() {
+				BeforeEach(func() {
+					baseMapper := clientBuilder.Build().RESTMapper()
+					podMonitorMapper := meta.NewDefaultRESTMapper(nil)
+					podMonitorMapper.Add(podMonitorGVK, meta.RESTScopeNamespace)
+
+					k8sClient = clientBuilder.
+						WithRESTMapper(meta.MultiRESTMapper{baseMapper, podMonitorMapper}).
+						WithObjects(existingSQLInstance).
+						Build()
+					controller = &SQLInstanceReconciler{Scheme: scheme.Scheme, Client: k8sClient, Recorder: recorder}
+				})
+
+				It("should create a pod monitor selecting the app's pods", func() {
+					req := ctrl.Request{NamespacedName: instanceIdentifier}
+					_, err := controller.Reconcile(ctx, req)
+					Expect(err).ToNot(HaveOccurred())
+
+					podMonitor, err := getPodMonitor()
+					Expect(err).ToNot(HaveOccurred())
+
+					Expect(podMonitor.GetLabels()).To(HaveKeyWithValue(managedByKey, sqeletorFqdnId))
+					Expect(podMonitor.GetOwnerReferences()).To(HaveLen(1))
+					Expect(podMonitor.GetOwnerReferences()[0].Kind).To(Equal("SQLInstance"))
+
+					matchLabels, _, err := unstructured.NestedStringMap(podMonitor.Object, "spec", "selector", "matchLabels")
+					Expect(err).ToNot(HaveOccurred())
+					Expect(matchLabels).To(Equal(map[string]string{appKey: "test-app"}))
+				})
+
+				It("should delete the pod monitor when no longer asked for", func() {
+					req := ctrl.Request{NamespacedName: instanceIdentifier}
+					_, err := controller.Reconcile(ctx, req)
+					Expect(err).ToNot(HaveOccurred())
+
+					instance := &v1beta1.SQLInstance{}
+					Expect(k8sClient.Get(ctx, instanceIdentifier, instance)).To(Succeed())
+					instance.Annotations[createPodMonitorAnnotation] = "false"
+					Expect(k8sClient.Update(ctx, instance)).To(Succeed())
+
+					_, err = controller.Reconcile(ctx, req)
+					Expect(err).ToNot(HaveOccurred())
+
+					_, err = getPodMonitor()
+					Expect(apierrors.IsNotFound(err)).To(BeTrue())
+				})
+			})
+
+			When("the PodMonitor CRD is not installed", func() {
+				BeforeEach(func() {
+					k8sClient = clientBuilder.WithObjects(existingSQLInstance).Build()
+					controller = &SQLInstanceReconciler{Scheme: scheme.Scheme, Client: k8sClient, Recorder: recorder}
+				})
+
+				It("should skip the pod monitor and still create the network policy", func() {
+					req := ctrl.Request{NamespacedName: instanceIdentifier}
+					_, err := controller.Reconcile(ctx, req)
+					Expect(err).ToNot(HaveOccurred())
+
+					Expect(k8sClient.Get(ctx, netpolIdentifier, &v1.NetworkPolicy{})).To(Succeed())
+				})
+			})
+		})
+
+		When("the NetworkPolicy API is unavailable", func() {
+			BeforeEach(func() {
+				existingSQLInstance := &v1beta1.SQLInstance{
+					TypeMeta: meta_v1.TypeMeta{
+						APIVersion: "sql.cnrm.cloud.google.com/v1beta1",
+						Kind:       "SQLInstance",
+					},
+					ObjectMeta: meta_v1.ObjectMeta{
+						Name:      instanceIdentifier.Name,
+						Namespace: instanceIdentifier.Namespace,
+						Labels: map[string]string{
+							appKey: "test-app",
+						},
+					},
+					Spec: v1beta1.SQLInstanceSpec{
+						ResourceID: ptr.To("resource-id"),
+					},
+					Status: v1beta1.SQLInstanceStatus{
+						IpAddress: []v1beta1.InstanceIpAddressStatus{
+							{
+								IpAddress: ptr.To("10.10.10.10"),
+								Type:      ptr.To("PRIVATE"),
+							},
+						},
+					},
+				}
+
+				// a scheme without networking.k8s.io
+				withoutNetworkPolicy := runtime.NewScheme()
+				utilruntime.Must(v1beta1.AddToScheme(withoutNetworkPolicy))
+
+				k8sClient = fake.NewClientBuilder().
+					WithScheme(withoutNetworkPolicy).
+					WithObjects(existingSQLInstance).
+					Build()
+				controller = &SQLInstanceReconciler{Scheme: withoutNetworkPolicy, Client: k8sClient, Recorder: recorder}
+			})
+
+			It("should return a permanent error and emit a warning event", func() {
+				req := ctrl.Request{NamespacedName: instanceIdentifier}
+				_, err := controller.Reconcile(ctx, req)
+				Expect(err).To(MatchError(errPermanentFailure))
+				Expect(err).To(MatchError(ContainSubstring("NetworkPolicy API unavailable")))
+
+				Expect(recorder.Events).To(Receive(HavePrefix("Warning NetworkPolicyUnavailable")))
+			})
 		})
 
 		When("the resource exists", func() {
@@ -48,6 +682,9 @@ var _ = Describe("SQLInstance Controller", func() {
 					ObjectMeta: meta_v1.ObjectMeta{
 						Name:      instanceIdentifier.Name,
 						Namespace: instanceIdentifier.Namespace,
+						Labels: map[string]string{
+							appKey: "test-app",
+						},
 					},
 					Spec: v1beta1.SQLInstanceSpec{
 						ResourceID: ptr.To("resource-id"),
@@ -71,7 +708,7 @@ var _ = Describe("SQLInstance Controller", func() {
 			When("no netpol exists", func() {
 				BeforeEach(func() {
 					k8sClient = clientBuilder.Build()
-					controller = &SQLInstanceReconciler{Scheme: scheme.Scheme, Client: k8sClient}
+					controller = &SQLInstanceReconciler{Scheme: scheme.Scheme, Client: k8sClient, Recorder: recorder}
 				})
 
 				It("should successfully reconcile the resource", func() {
@@ -82,7 +719,69 @@ var _ = Describe("SQLInstance Controller", func() {
 					Expect(result).To(Equal(ctrl.Result{}))
 				})
 
-				It("should create a network policy allowing egress to the ip of the instance", func() {
+				It("should limit egress to the postgres port and the additional ports", func() {
+					instance := &v1beta1.SQLInstance{}
+					Expect(k8sClient.Get(ctx, instanceIdentifier, instance)).To(Succeed())
+					instance.Annotations = map[string]string{egressPortsAnnotation: "3307, 9000-9100"}
+					Expect(k8sClient.Update(ctx, instance)).To(Succeed())
+
+					req := ctrl.Request{NamespacedName: instanceIdentifier}
+					_, err := controller.Reconcile(ctx, req)
+					Expect(err).ToNot(HaveOccurred())
+
+					netpol := &v1.NetworkPolicy{}
+					Expect(k8sClient.Get(ctx, netpolIdentifier, netpol)).To(Succeed())
+					Expect(netpol.Spec.Egress).To(HaveLen(1))
+					for _, rule := range netpol.Spec.Egress {
+						Expect(rule.Ports).To(HaveExactElements(
+							v1.NetworkPolicyPort{Protocol: ptr.To(core_v1.ProtocolTCP), Port: ptr.To(intstr.FromInt32(5432))},
+							v1.NetworkPolicyPort{Protocol: ptr.To(core_v1.ProtocolTCP), Port: ptr.To(intstr.FromInt32(3307))},
+							v1.NetworkPolicyPort{Protocol: ptr.To(core_v1.ProtocolTCP), Port: ptr.To(intstr.FromInt32(9000)), EndPort: ptr.To(int32(9100))},
+						))
+					}
+				})
+
+				It("should reject egress ports out of range", func() {
+					instance := &v1beta1.SQLInstance{}
+					Expect(k8sClient.Get(ctx, instanceIdentifier, instance)).To(Succeed())
+					instance.Annotations = map[string]string{egressPortsAnnotation: "3307,70000"}
+					Expect(k8sClient.Update(ctx, instance)).To(Succeed())
+
+					req := ctrl.Request{NamespacedName: instanceIdentifier}
+					_, err := controller.Reconcile(ctx, req)
+					Expect(err).To(MatchError(errPermanentFailure))
+					Expect(recorder.Events).To(Receive(HavePrefix("Warning InvalidEgressPorts")))
+				})
+
+				It("should requeue while the instance has no ip address", func() {
+					instance := &v1beta1.SQLInstance{}
+					Expect(k8sClient.Get(ctx, instanceIdentifier, instance)).To(Succeed())
+					instance.Status.IpAddress = nil
+					Expect(k8sClient.Update(ctx, instance)).To(Succeed())
+					requeuesBefore := testutil.ToFloat64(requeueReasonMetric.WithLabelValues("SQLInstance", string(reasonWaitingForInstanceIP)))
+
+					req := ctrl.Request{NamespacedName: instanceIdentifier}
+					result, err := controller.Reconcile(ctx, req)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(result.RequeueAfter).To(BeNumerically(">", 0))
+					Expect(testutil.ToFloat64(requeueReasonMetric.WithLabelValues("SQLInstance", string(reasonWaitingForInstanceIP)))).To(Equal(requeuesBefore + 1))
+				})
+
+				It("should count the ips in the network policy and clean up when the instance is deleted", func() {
+					req := ctrl.Request{NamespacedName: instanceIdentifier}
+					_, err := controller.Reconcile(ctx, req)
+					Expect(err).ToNot(HaveOccurred())
+
+					Expect(testutil.ToFloat64(netpolIPCountMetric.WithLabelValues(instanceIdentifier.Namespace, instanceIdentifier.Name))).To(Equal(1.0))
+
+					Expect(k8sClient.Delete(ctx, &v1beta1.SQLInstance{ObjectMeta: meta_v1.ObjectMeta{Name: instanceIdentifier.Name, Namespace: instanceIdentifier.Namespace}})).To(Succeed())
+					_, err = controller.Reconcile(ctx, req)
+					Expect(err).ToNot(HaveOccurred())
+
+					Expect(netpolIPCountMetric.DeleteLabelValues(instanceIdentifier.Namespace, instanceIdentifier.Name)).To(BeFalse())
+				})
+
+				It("should create a network policy allowing egress to the private ip of the instance", func() {
 					req := ctrl.Request{NamespacedName: instanceIdentifier}
 					_, err := controller.Reconcile(ctx, req)
 					Expect(err).ToNot(HaveOccurred())
@@ -101,18 +800,196 @@ var _ = Describe("SQLInstance Controller", func() {
 								},
 							},
 						},
-						{
-							To: []v1.NetworkPolicyPeer{
-								{
-									IPBlock: &v1.IPBlock{
-										CIDR: "35.35.35.35/32",
-									},
-								},
-							},
-						},
 					}))
 				})
 
+				It("should annotate the network policy with the connection name of the instance", func() {
+					req := ctrl.Request{NamespacedName: instanceIdentifier}
+					_, err := controller.Reconcile(ctx, req)
+					Expect(err).ToNot(HaveOccurred())
+
+					netpol := &v1.NetworkPolicy{}
+					Expect(k8sClient.Get(ctx, netpolIdentifier, netpol)).To(Succeed())
+					Expect(netpol.Annotations).ToNot(HaveKey(instanceConnectionNameAnnotation))
+
+					instance := &v1beta1.SQLInstance{}
+					Expect(k8sClient.Get(ctx, instanceIdentifier, instance)).To(Succeed())
+					instance.Status.ConnectionName = ptr.To("test-project:europe-north1:resource-id")
+					Expect(k8sClient.Update(ctx, instance)).To(Succeed())
+
+					_, err = controller.Reconcile(ctx, req)
+					Expect(err).ToNot(HaveOccurred())
+
+					Expect(k8sClient.Get(ctx, netpolIdentifier, netpol)).To(Succeed())
+					Expect(netpol.Annotations).To(HaveKeyWithValue(instanceConnectionNameAnnotation, "test-project:europe-north1:resource-id"))
+				})
+
+				It("should also allow egress to the public ip when annotated", func() {
+					instance := &v1beta1.SQLInstance{}
+					Expect(k8sClient.Get(ctx, instanceIdentifier, instance)).To(Succeed())
+					instance.Annotations = map[string]string{publicIPEgressAnnotation: "true"}
+					Expect(k8sClient.Update(ctx, instance)).To(Succeed())
+
+					req := ctrl.Request{NamespacedName: instanceIdentifier}
+					_, err := controller.Reconcile(ctx, req)
+					Expect(err).ToNot(HaveOccurred())
+
+					netpol := &v1.NetworkPolicy{}
+					Expect(k8sClient.Get(ctx, netpolIdentifier, netpol)).To(Succeed())
+					Expect(netpol.Spec.Egress).To(HaveExactElements(
+						HaveField("To", ConsistOf(HaveField("IPBlock.CIDR", "10.10.10.10/32"))),
+						HaveField("To", ConsistOf(HaveField("IPBlock.CIDR", "35.35.35.35/32"))),
+					))
+				})
+
+				It("should allow egress to the public ip in a network policy of its own when split", func() {
+					instance := &v1beta1.SQLInstance{}
+					Expect(k8sClient.Get(ctx, instanceIdentifier, instance)).To(Succeed())
+					instance.Annotations = map[string]string{publicIPEgressAnnotation: "true", splitPublicIPEgressAnnotation: "true"}
+					Expect(k8sClient.Update(ctx, instance)).To(Succeed())
+
+					req := ctrl.Request{NamespacedName: instanceIdentifier}
+					_, err := controller.Reconcile(ctx, req)
+					Expect(err).ToNot(HaveOccurred())
+
+					netpol := &v1.NetworkPolicy{}
+					Expect(k8sClient.Get(ctx, netpolIdentifier, netpol)).To(Succeed())
+					Expect(netpol.Labels).To(HaveKeyWithValue(egressScopeLabelKey, egressScopePrivate))
+					Expect(netpol.Spec.Egress).To(HaveExactElements(
+						HaveField("To", ConsistOf(HaveField("IPBlock.CIDR", "10.10.10.10/32"))),
+					))
+
+					publicNetpolIdentifier := types.NamespacedName{Name: netpolIdentifier.Name + "-public", Namespace: netpolIdentifier.Namespace}
+					publicNetpol := &v1.NetworkPolicy{}
+					Expect(k8sClient.Get(ctx, publicNetpolIdentifier, publicNetpol)).To(Succeed())
+					Expect(publicNetpol.Labels).To(HaveKeyWithValue(egressScopeLabelKey, egressScopePublic))
+					Expect(publicNetpol.Labels).To(HaveKeyWithValue(appKey, "test-app"))
+					Expect(publicNetpol.OwnerReferences).To(HaveExactElements(HaveField("Name", instanceIdentifier.Name)))
+					Expect(publicNetpol.Spec.PodSelector).To(Equal(netpol.Spec.PodSelector))
+					Expect(publicNetpol.Spec.Egress).To(HaveExactElements(
+						HaveField("To", ConsistOf(HaveField("IPBlock.CIDR", "35.35.35.35/32"))),
+					))
+					Expect(testutil.ToFloat64(netpolIPCountMetric.WithLabelValues(instanceIdentifier.Namespace, instanceIdentifier.Name))).To(Equal(2.0))
+
+					Expect(k8sClient.Get(ctx, instanceIdentifier, instance)).To(Succeed())
+					instance.Annotations = map[string]string{publicIPEgressAnnotation: "true"}
+					Expect(k8sClient.Update(ctx, instance)).To(Succeed())
+					_, err = controller.Reconcile(ctx, req)
+					Expect(err).ToNot(HaveOccurred())
+
+					Expect(apierrors.IsNotFound(k8sClient.Get(ctx, publicNetpolIdentifier, &v1.NetworkPolicy{}))).To(BeTrue())
+					Expect(k8sClient.Get(ctx, netpolIdentifier, netpol)).To(Succeed())
+					Expect(netpol.Labels).ToNot(HaveKey(egressScopeLabelKey))
+					Expect(netpol.Spec.Egress).To(HaveLen(2))
+				})
+
+				It("should leave a public network policy it does not own alone", func() {
+					publicNetpol := &v1.NetworkPolicy{
+						ObjectMeta: meta_v1.ObjectMeta{Name: netpolIdentifier.Name + "-public", Namespace: netpolIdentifier.Namespace},
+					}
+					Expect(k8sClient.Create(ctx, publicNetpol)).To(Succeed())
+
+					req := ctrl.Request{NamespacedName: instanceIdentifier}
+					_, err := controller.Reconcile(ctx, req)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(publicNetpol), &v1.NetworkPolicy{})).To(Succeed())
+				})
+
+				It("should refuse an instance with only a public ip unless egress to it is allowed", func() {
+					instance := &v1beta1.SQLInstance{}
+					Expect(k8sClient.Get(ctx, instanceIdentifier, instance)).To(Succeed())
+					instance.Status.IpAddress = []v1beta1.InstanceIpAddressStatus{
+						{IpAddress: ptr.To("35.35.35.35"), Type: ptr.To("PRIMARY")},
+					}
+					Expect(k8sClient.Update(ctx, instance)).To(Succeed())
+
+					req := ctrl.Request{NamespacedName: instanceIdentifier}
+					_, err := controller.Reconcile(ctx, req)
+					Expect(err).To(MatchError(errPermanentFailure))
+					Expect(recorder.Events).To(Receive(HavePrefix("Warning PublicIPOnly")))
+					Expect(apierrors.IsNotFound(k8sClient.Get(ctx, netpolIdentifier, &v1.NetworkPolicy{}))).To(BeTrue())
+
+					Expect(k8sClient.Get(ctx, instanceIdentifier, instance)).To(Succeed())
+					instance.Annotations = map[string]string{publicIPEgressAnnotation: "true"}
+					Expect(k8sClient.Update(ctx, instance)).To(Succeed())
+					_, err = controller.Reconcile(ctx, req)
+					Expect(err).ToNot(HaveOccurred())
+
+					netpol := &v1.NetworkPolicy{}
+					Expect(k8sClient.Get(ctx, netpolIdentifier, netpol)).To(Succeed())
+					Expect(netpol.Spec.Egress).To(HaveExactElements(
+						HaveField("To", ConsistOf(HaveField("IPBlock.CIDR", "35.35.35.35/32"))),
+					))
+				})
+
+				It("should delete the network policy once egress to the remaining public ip is not allowed", func() {
+					req := ctrl.Request{NamespacedName: instanceIdentifier}
+					_, err := controller.Reconcile(ctx, req)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(k8sClient.Get(ctx, netpolIdentifier, &v1.NetworkPolicy{})).To(Succeed())
+
+					instance := &v1beta1.SQLInstance{}
+					Expect(k8sClient.Get(ctx, instanceIdentifier, instance)).To(Succeed())
+					instance.Status.IpAddress = []v1beta1.InstanceIpAddressStatus{
+						{IpAddress: ptr.To("35.35.35.35"), Type: ptr.To("PRIMARY")},
+					}
+					Expect(k8sClient.Update(ctx, instance)).To(Succeed())
+
+					_, err = controller.Reconcile(ctx, req)
+					Expect(err).To(MatchError(errPermanentFailure))
+					Expect(apierrors.IsNotFound(k8sClient.Get(ctx, netpolIdentifier, &v1.NetworkPolicy{}))).To(BeTrue())
+				})
+
+				It("should not write the network policy while paused and resume when unpaused", func() {
+					setPaused := func(paused bool) {
+						instance := &v1beta1.SQLInstance{}
+						Expect(k8sClient.Get(ctx, instanceIdentifier, instance)).To(Succeed())
+						if paused {
+							meta_v1.SetMetaDataAnnotation(&instance.ObjectMeta, pausedAnnotation, "true")
+						} else {
+							delete(instance.Annotations, pausedAnnotation)
+						}
+						Expect(k8sClient.Update(ctx, instance)).To(Succeed())
+					}
+					setPaused(true)
+
+					req := ctrl.Request{NamespacedName: instanceIdentifier}
+					_, err := controller.Reconcile(ctx, req)
+					Expect(err).ToNot(HaveOccurred())
+
+					err = k8sClient.Get(ctx, netpolIdentifier, &v1.NetworkPolicy{})
+					Expect(apierrors.IsNotFound(err)).To(BeTrue())
+
+					setPaused(false)
+					_, err = controller.Reconcile(ctx, req)
+					Expect(err).ToNot(HaveOccurred())
+
+					Expect(k8sClient.Get(ctx, netpolIdentifier, &v1.NetworkPolicy{})).To(Succeed())
+				})
+
+				It("should update the last success timestamp", func() {
+					lastSuccessfulReconcileMetric.WithLabelValues("SQLInstance").Set(0)
+
+					req := ctrl.Request{NamespacedName: instanceIdentifier}
+					_, err := controller.Reconcile(ctx, req)
+					Expect(err).ToNot(HaveOccurred())
+
+					lastSuccess := testutil.ToFloat64(lastSuccessfulReconcileMetric.WithLabelValues("SQLInstance"))
+					Expect(time.Unix(int64(lastSuccess), 0)).To(BeTemporally("~", time.Now(), 5*time.Second))
+				})
+
+				It("should select pods by the app label of the instance", func() {
+					req := ctrl.Request{NamespacedName: instanceIdentifier}
+					_, err := controller.Reconcile(ctx, req)
+					Expect(err).ToNot(HaveOccurred())
+
+					netpol := &v1.NetworkPolicy{}
+					err = k8sClient.Get(ctx, netpolIdentifier, netpol)
+					Expect(err).ToNot(HaveOccurred())
+
+					Expect(netpol.Spec.PodSelector.MatchLabels).To(Equal(map[string]string{appKey: "test-app"}))
+				})
+
 				It("should set owner reference and managed by", func() {
 					req := ctrl.Request{NamespacedName: instanceIdentifier}
 					_, err := controller.Reconcile(ctx, req)
@@ -159,7 +1036,7 @@ var _ = Describe("SQLInstance Controller", func() {
 					}
 
 					k8sClient = clientBuilder.WithObjects(existingNetPol).Build()
-					controller = &SQLInstanceReconciler{Scheme: scheme.Scheme, Client: k8sClient}
+					controller = &SQLInstanceReconciler{Scheme: scheme.Scheme, Client: k8sClient, Recorder: recorder}
 				})
 
 				It("should not update the network policy", func() {
@@ -237,7 +1114,7 @@ var _ = Describe("SQLInstance Controller", func() {
 					}
 
 					k8sClient = clientBuilder.WithObjects(existingNetPol).Build()
-					controller = &SQLInstanceReconciler{Scheme: scheme.Scheme, Client: k8sClient}
+					controller = &SQLInstanceReconciler{Scheme: scheme.Scheme, Client: k8sClient, Recorder: recorder}
 				})
 
 				It("should not update the network policy", func() {
@@ -258,14 +1135,6 @@ var _ = Describe("SQLInstance Controller", func() {
 									},
 								},
 							},
-						}, {
-							To: []v1.NetworkPolicyPeer{
-								{
-									IPBlock: &v1.IPBlock{
-										CIDR: "35.35.35.35/32",
-									},
-								},
-							},
 						},
 					}))
 
@@ -275,3 +1144,58 @@ var _ = Describe("SQLInstance Controller", func() {
 		})
 	})
 })
+
+var _ = Describe("Egress CIDRs", func() {
+	It("should order by address, then prefix length, with unparseable cidrs last", func() {
+		cidrs := []string{"garbage", "2001:db8::1/128", "10.0.0.0/8", "10.0.0.0/16", "9.9.9.9/32", "10.2.2.2/32"}
+		slices.SortFunc(cidrs, compareCIDRs)
+		Expect(cidrs).To(HaveExactElements("9.9.9.9/32", "10.0.0.0/8", "10.0.0.0/16", "10.2.2.2/32", "2001:db8::1/128", "garbage"))
+	})
+
+	It("should mask the ip to the prefix length, defaulting to the host", func() {
+		Expect(ipCIDR("10.10.10.10", 0)).To(Equal("10.10.10.10/32"))
+		Expect(ipCIDR("10.10.10.10", 28)).To(Equal("10.10.10.0/28"))
+		Expect(ipCIDR("2001:db8::1", 0)).To(Equal("2001:db8::1/128"))
+		Expect(ipCIDR("2001:db8::1", 64)).To(Equal("2001:db8::/64"))
+		_, err := ipCIDR("10.10.10.10", 64)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should tell the address family of each prefix length by its length", func() {
+		Expect(parseEgressCIDRBits("/28")).To(Equal(egressCIDRBits{ipv4: 28}))
+		Expect(parseEgressCIDRBits("120")).To(Equal(egressCIDRBits{ipv6: 120}))
+		Expect(parseEgressCIDRBits("/120, /28")).To(Equal(egressCIDRBits{ipv4: 28, ipv6: 120}))
+		_, err := parseEgressCIDRBits("/48")
+		Expect(err).To(MatchError(ContainSubstring("neither an IPv4 prefix length")))
+		_, err = parseEgressCIDRBits("/64,/96")
+		Expect(err).To(MatchError(ContainSubstring("more than one IPv6 prefix length")))
+
+		bits := egressCIDRBits{ipv4: 28, ipv6: 120}
+		Expect(bits.forIP("10.10.10.10")).To(Equal(28))
+		Expect(bits.forIP("2001:db8::1")).To(Equal(120))
+	})
+
+	It("should refuse prefix lengths wider than the minimum", func() {
+		Expect(ipCIDR("10.10.10.10", 24)).To(Equal("10.10.10.0/24"))
+		_, err := ipCIDR("10.10.10.10", 2)
+		Expect(err).To(MatchError(ContainSubstring("shorter than the minimum of 24")))
+		_, err = ipCIDR("2001:db8::1", 48)
+		Expect(err).To(MatchError(ContainSubstring("shorter than the minimum of 64")))
+	})
+})
+
+var _ = Describe("Instance connection name", func() {
+	It("should construct the connection name until the status has it", func() {
+		instance := &v1beta1.SQLInstance{ObjectMeta: meta_v1.ObjectMeta{Name: "instance"}}
+		Expect(instanceConnectionName(instance)).To(BeEmpty())
+
+		instance.Annotations = map[string]string{cnrmProjectIDAnnotation: "test-project"}
+		instance.Spec.Region = ptr.To("europe-north1")
+		Expect(instanceConnectionName(instance)).To(Equal("test-project:europe-north1:instance"))
+		instance.Spec.ResourceID = ptr.To("resource-id")
+		Expect(instanceConnectionName(instance)).To(Equal("test-project:europe-north1:resource-id"))
+
+		instance.Status.ConnectionName = ptr.To("other-project:europe-west1:resource-id")
+		Expect(instanceConnectionName(instance)).To(Equal("other-project:europe-west1:resource-id"))
+	})
+})
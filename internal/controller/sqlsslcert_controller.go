@@ -2,10 +2,14 @@ package controller
 
 import (
 	"context"
-	"crypto/x509"
-	"encoding/pem"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"slices"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/GoogleCloudPlatform/k8s-config-connector/pkg/clients/generated/apis/sql/v1beta1"
@@ -13,12 +17,20 @@ import (
 	core_v1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/clock"
+	"k8s.io/utils/ptr"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/metrics"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
 )
 
 const (
@@ -26,55 +38,176 @@ const (
 	pk1PemKeyKey = "key.pem"
 	pk8DerKeyKey = "key.pk8"
 	rootCertKey  = "root-cert.pem"
+	// rootCertDerKey holds the first certificate of the server CA in DER form, for native clients not reading PEM
+	rootCertDerKey = "root-cert.der"
+
+	// certGenerationAnnotation is bumped every time the certificate content in the secret changes,
+	// so that consumers (e.g. a sidecar) can watch for rotations.
+	certGenerationAnnotation = "sqeletor.nais.io/cert-generation"
+	certHashAnnotation       = "sqeletor.nais.io/cert-hash"
+
+	// splitSecretsAnnotation writes each file to its own secret, for finer grained access control
+	splitSecretsAnnotation = "sqeletor.nais.io/split-secrets"
+	// rootCertDerAnnotation enables the root-cert.der key. DER holds a single certificate, so of a CA bundle only
+	// the first certificate is written.
+	rootCertDerAnnotation = "sqeletor.nais.io/root-cert-der"
+	// pk8Base64Annotation writes key.pk8 as base64 text rather than raw DER, for consumers expecting the mounted
+	// file to hold base64
+	pk8Base64Annotation = "sqeletor.nais.io/pk8-base64"
 )
 
+// certKeys are the keys written for a certificate
+var certKeys = []string{certKey, pk1PemKeyKey, pk8DerKeyKey, rootCertKey}
+
+// optionalCertKeys are the keys written for a certificate only when enabled by an annotation
+var optionalCertKeys = []string{rootCertDerKey}
+
+// binaryCertKeys are the keys holding DER rather than PEM
+var binaryCertKeys = []string{pk8DerKeyKey, rootCertDerKey}
+
+// splitSecretSuffixes are appended to the secret name to name the secret of each key, when secrets are split
+var splitSecretSuffixes = map[string]string{
+	certKey:        "cert",
+	pk1PemKeyKey:   "key",
+	pk8DerKeyKey:   "pk8",
+	rootCertKey:    "ca",
+	rootCertDerKey: "ca-der",
+}
+
 var requeuesMetric = prometheus.NewCounter(prometheus.CounterOpts{
 	Name: "sqlsslcert_requeues",
-	Help: "Number of requeues for SQLSSLCert",
+	Help: "Deprecated: use sqeletor_reconcile_total{result=\"requeue\"}. Number of requeues for SQLSSLCert",
 })
 
 func init() {
 	metrics.Registry.MustRegister(requeuesMetric)
 }
 
+// DefaultCertExpiryThreshold is how close to expiry a cert is counted as expiring soon, unless configured otherwise
+const DefaultCertExpiryThreshold = 30 * 24 * time.Hour
+
+// certExpiries tracks when the certificate of each reconciled SQLSSLCert expires. It is safe for concurrent use, as
+// it is read when the metrics are scraped.
+type certExpiries struct {
+	mu       sync.Mutex
+	notAfter map[types.NamespacedName]time.Time
+}
+
+func (c *certExpiries) set(key types.NamespacedName, notAfter time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.notAfter == nil {
+		c.notAfter = make(map[types.NamespacedName]time.Time)
+	}
+	c.notAfter[key] = notAfter
+}
+
+func (c *certExpiries) forget(key types.NamespacedName) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.notAfter, key)
+}
+
+// expiringWithin counts the certificates expiring within threshold of now, including those already expired.
+func (c *certExpiries) expiringWithin(now time.Time, threshold time.Duration) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	count := 0
+	for _, notAfter := range c.notAfter {
+		if notAfter.Sub(now) < threshold {
+			count++
+		}
+	}
+	return count
+}
+
 // SQLSSLCertReconciler reconciles a SQLSSLCert object
 type SQLSSLCertReconciler struct {
 	client.Client
-	Scheme *runtime.Scheme
+	Scheme        *runtime.Scheme
+	Recorder      record.EventRecorder
+	LabelSelector labels.Selector
+	// StrictOwnership reports managed labels that were changed externally, in addition to resetting them.
+	StrictOwnership bool
+	// ResourceMetricLabels labels the reconcile metrics with the team and app of the resource.
+	ResourceMetricLabels bool
+	// NoOwnerReferences records the owner of the secret in an annotation instead of an owner reference, and cleans
+	// up the secret using a finalizer. For secrets also tracked by GitOps tools, which conflict with foreign owners.
+	NoOwnerReferences bool
+	// Clock is used for timestamps, defaults to the real clock.
+	Clock clock.PassiveClock
+	// CertExpiryThreshold is how close to expiry a cert is counted in the expiring soon metric, defaults to DefaultCertExpiryThreshold.
+	CertExpiryThreshold time.Duration
+	// Trigger enqueues reconciles requested through the admin endpoint, if set.
+	Trigger *ReconcileTrigger
+
+	certExpiries certExpiries
 }
 
 func (r *SQLSSLCertReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 	logger := log.FromContext(ctx)
+	start := time.Now()
 
-	err := r.reconcileSQLSSLCert(ctx, req)
+	// filled in by the reconcile, and left empty if the cert is gone
+	sqlSslCert := &v1beta1.SQLSSLCert{}
+	err := r.reconcileSQLSSLCert(ctx, req, sqlSslCert)
+	resource := metricResourceLabels(r.ResourceMetricLabels, sqlSslCert)
 	if errors.Is(err, errTemporaryFailure) {
 		requeuesMetric.Inc()
+		observeRequeue("SQLSSLCert", err)
+		observeReconcile("SQLSSLCert", reconcileResultRequeue, start, resource)
 		logger.Error(err, "requeueing after temporary failure")
 		return ctrl.Result{
-			RequeueAfter: time.Minute,
+			RequeueAfter: requeueInterval(ctx, sqlSslCert),
 		}, nil
 	}
 	if err != nil {
+		observeReconcile("SQLSSLCert", reconcileResultError, start, resource)
 		logger.Error(err, "failed to reconcile SQLSSLCert")
+		return ctrl.Result{}, err
 	}
-	return ctrl.Result{}, err
+	observeReconcile("SQLSSLCert", reconcileResultSuccess, start, resource)
+	lastSuccessfulReconcileMetric.WithLabelValues("SQLSSLCert").SetToCurrentTime()
+	return ctrl.Result{}, nil
 }
 
-func (r *SQLSSLCertReconciler) reconcileSQLSSLCert(ctx context.Context, req ctrl.Request) error {
+func (r *SQLSSLCertReconciler) reconcileSQLSSLCert(ctx context.Context, req ctrl.Request, sqlSslCert *v1beta1.SQLSSLCert) error {
 	logger := log.FromContext(ctx)
 
-	sqlSslCert := &v1beta1.SQLSSLCert{}
 	if err := r.Client.Get(ctx, req.NamespacedName, sqlSslCert); err != nil {
 		if apierrors.IsNotFound(err) {
 			logger.Info("SQLSSLCert not found, aborting reconcile")
+			r.certExpiries.forget(req.NamespacedName)
 			return nil
 		}
 		return temporaryFailureError(fmt.Errorf("failed to get SQLSSLCert: %w", err))
 	}
 
+	if !sqlSslCert.DeletionTimestamp.IsZero() {
+		r.certExpiries.forget(req.NamespacedName)
+		if !controllerutil.ContainsFinalizer(sqlSslCert, secretCleanupFinalizer) {
+			return nil
+		}
+		logger.Info("SQLSSLCert is being deleted, cleaning up secret")
+		secretNames := []string{}
+		if secretName := sqlSslCert.Annotations["sqeletor.nais.io/secret-name"]; secretName != "" {
+			secretNames = append(secretNames, secretName)
+			for _, key := range slices.Concat(certKeys, optionalCertKeys) {
+				secretNames = append(secretNames, splitSecretName(secretName, key))
+			}
+		}
+		return cleanupSecrets(ctx, r.Client, sqlSslCert, secretNames...)
+	}
+
+	if boolAnnotation(sqlSslCert, pausedAnnotation, false) {
+		logger.Info("SQLSSLCert is paused, leaving secret untouched", "annotation", pausedAnnotation)
+		return nil
+	}
+
 	secretName, ok := sqlSslCert.Annotations["sqeletor.nais.io/secret-name"]
 	if !ok {
 		logger.V(4).Info("ignoring: secret name annotation not found")
+		r.certExpiries.forget(req.NamespacedName)
 		return nil
 	}
 	logger = logger.WithValues("secret", secretName)
@@ -87,11 +220,106 @@ func (r *SQLSSLCertReconciler) reconcileSQLSSLCert(ctx context.Context, req ctrl
 			sqlSslCert.Status.PrivateKey != nil,
 			sqlSslCert.Status.ServerCaCert != nil,
 		)
-		return temporaryFailureError(err)
+		return temporaryFailureErrorFor(reasonWaitingForCertStatus, err)
+	}
+	// during rotation the cert may be updated before the key, so wait rather than write a pair that doesn't work
+	if err := verifyCertKeyPair([]byte(*sqlSslCert.Status.Cert), []byte(*sqlSslCert.Status.PrivateKey)); err != nil {
+		logger.Info("Cert and private key in status don't match, keeping the existing secret until rotation completes")
+		return temporaryFailureErrorFor(reasonWaitingForCertStatus, err)
+	}
+	if cert := firstCertificate([]byte(*sqlSslCert.Status.Cert)); cert != nil {
+		r.certExpiries.set(req.NamespacedName, cert.NotAfter)
+	} else {
+		r.certExpiries.forget(req.NamespacedName)
+	}
+
+	// without an owner reference, garbage collection won't delete the secret with the cert
+	if r.NoOwnerReferences {
+		if err := ensureSecretCleanupFinalizer(ctx, r.Client, sqlSslCert); err != nil {
+			return err
+		}
+	}
+
+	// an empty key.pk8 would only surface as a confusing tls error in the clients
+	derKey, err := pemToPkcs8Der([]byte(*sqlSslCert.Status.PrivateKey))
+	if err != nil {
+		r.Recorder.Eventf(sqlSslCert, core_v1.EventTypeWarning, "InvalidPrivateKey", "Unable to convert the private key in status to PKCS#8 DER: %v", err)
+		return permanentFailureError(fmt.Errorf("failed to convert private key to DER: %w", err))
+	}
+	files := map[string][]byte{
+		certKey:      []byte(*sqlSslCert.Status.Cert),
+		pk1PemKeyKey: []byte(*sqlSslCert.Status.PrivateKey),
+		pk8DerKeyKey: derKey,
+		rootCertKey:  []byte(*sqlSslCert.Status.ServerCaCert),
+	}
+	keys := certKeys
+	if boolAnnotation(sqlSslCert, rootCertDerAnnotation, false) {
+		if caCert := firstCertificate(files[rootCertKey]); caCert != nil {
+			files[rootCertDerKey] = caCert.Raw
+			keys = append(slices.Clone(certKeys), rootCertDerKey)
+		} else {
+			logger.Info("Failed to decode server CA cert, leaving out its DER form")
+		}
 	}
+	allKeys := slices.Concat(certKeys, optionalCertKeys)
 
-	secret := &core_v1.Secret{ObjectMeta: meta_v1.ObjectMeta{Namespace: req.Namespace, Name: secretName}}
-	op, err := controllerutil.CreateOrUpdate(ctx, r.Client, secret, func() error {
+	if boolAnnotation(sqlSslCert, splitSecretsAnnotation, false) {
+		for _, key := range allKeys {
+			if !slices.Contains(keys, key) {
+				if err := releaseSecret(ctx, r.Client, sqlSslCert, splitSecretName(secretName, key), secretKindCertificate, key); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := r.reconcileSecret(ctx, sqlSslCert, splitSecretName(secretName, key), files, key); err != nil {
+				return err
+			}
+		}
+		// the keys were in the combined secret before the secrets were split
+		if err := releaseSecret(ctx, r.Client, sqlSslCert, secretName, secretKindCertificate, allKeys...); err != nil {
+			return err
+		}
+	} else {
+		if err := r.reconcileSecret(ctx, sqlSslCert, secretName, files, keys...); err != nil {
+			return err
+		}
+		for _, key := range allKeys {
+			if err := releaseSecret(ctx, r.Client, sqlSslCert, splitSecretName(secretName, key), secretKindCertificate, key); err != nil {
+				return err
+			}
+		}
+	}
+
+	// the secrets have owner references again, so the finalizer from running without them is no longer needed
+	if !r.NoOwnerReferences {
+		if err := removeSecretCleanupFinalizer(ctx, r.Client, sqlSslCert); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reconcileSecret writes the given keys of files to the named secret, owned by the sql ssl cert.
+func (r *SQLSSLCertReconciler) reconcileSecret(ctx context.Context, sqlSslCert *v1beta1.SQLSSLCert, secretName string, files map[string][]byte, keys ...string) error {
+	logger := log.FromContext(ctx).WithValues("secret", secretName)
+
+	secretType, err := secretTypeOf(sqlSslCert)
+	if err != nil {
+		return err
+	}
+	ownerReference, err := ownerReferenceFor(r.Scheme, sqlSslCert)
+	if err != nil {
+		return err
+	}
+	if err := ensureSecretType(ctx, r.Client, r.Recorder, sqlSslCert, types.NamespacedName{Namespace: sqlSslCert.Namespace, Name: secretName}, ownerReference, secretType); err != nil {
+		return err
+	}
+
+	var driftedLabels []string
+	secret := &core_v1.Secret{ObjectMeta: meta_v1.ObjectMeta{Namespace: sqlSslCert.Namespace, Name: secretName}}
+	op, err := createOrUpdate(ctx, r.Client, secret, func() error {
+		driftedLabels = nil
+		isNew := secret.CreationTimestamp.IsZero()
 		if secret.Labels == nil {
 			secret.Labels = make(map[string]string)
 		}
@@ -99,40 +327,57 @@ func (r *SQLSSLCertReconciler) reconcileSQLSSLCert(ctx context.Context, req ctrl
 			secret.Annotations = make(map[string]string)
 		}
 
-		ownerReference := meta_v1.OwnerReference{
-			APIVersion: sqlSslCert.GetObjectKind().GroupVersionKind().GroupVersion().String(),
-			Kind:       sqlSslCert.GetObjectKind().GroupVersionKind().Kind,
-			Name:       sqlSslCert.GetName(),
-			UID:        sqlSslCert.GetUID(),
-		}
-
-		// if new resource, add owner reference and managed-by label.
+		// if new resource, add managed-by label.
 		// the secret is owned by the sql ssl cert resource.
-		if secret.CreationTimestamp.IsZero() {
-			secret.OwnerReferences = []meta_v1.OwnerReference{ownerReference}
+		if isNew {
 			secret.Labels[managedByKey] = sqeletorFqdnId
-		} else if err := validateOwnership(ownerReference, secret); err != nil {
+			secret.Type = secretType
+		} else if err := validateOwnership(ownerReference, secret, sharedSecretCoOwners(ownerReference, secret)...); err != nil {
 			return err
 		}
+		// the secret may be shared with sql users, in which case all are owners.
+		setOwner(ownerReference, secret, r.NoOwnerReferences)
 
-		secret.Labels[typeKey] = sqeletorFqdnId
-		secret.Labels[appKey] = sqlSslCert.Labels[appKey]
-		secret.Labels[teamKey] = sqlSslCert.Labels[teamKey]
+		drifted := setSecretLabels(secret, ownerReference, secretKindCertificate, map[string]string{
+			appKey:  sqlSslCert.Labels[appKey],
+			teamKey: sqlSslCert.Labels[teamKey],
+		})
+		if !isNew {
+			driftedLabels = drifted
+		}
 
 		secret.Annotations[deploymentCorrelationIdKey] = sqlSslCert.Annotations[deploymentCorrelationIdKey]
-		secret.Annotations[lastUpdatedAnnotation] = time.Now().Format(time.RFC3339)
+		setSourceGeneration(secret, ownerReference, sqlSslCert.Generation)
 
-		derKey, err := pemToPkcs8Der(*sqlSslCert.Status.PrivateKey)
-		if err != nil {
-			logger.Info("Failed to convert cert to DER", "error", err)
+		// merge rather than replace, as the secret may also hold keys written by the sql user controller
+		if secret.Data == nil {
+			secret.Data = make(map[string][]byte)
 		}
-		secret.Data = map[string][]byte{
-			pk8DerKeyKey: derKey,
+		if secret.StringData == nil {
+			secret.StringData = make(map[string]string)
 		}
-		secret.StringData = map[string]string{
-			certKey:      *sqlSslCert.Status.Cert,
-			pk1PemKeyKey: *sqlSslCert.Status.PrivateKey,
-			rootCertKey:  *sqlSslCert.Status.ServerCaCert,
+		pk8Base64 := boolAnnotation(sqlSslCert, pk8Base64Annotation, false)
+		for _, key := range keys {
+			switch {
+			case key == pk8DerKeyKey && pk8Base64:
+				setSecretString(secret, key, base64.StdEncoding.EncodeToString(files[key]))
+			case slices.Contains(binaryCertKeys, key):
+				// binary, so it can't go through StringData
+				secret.Data[key] = files[key]
+			default:
+				setSecretString(secret, key, string(files[key]))
+			}
+		}
+		setManagedKeys(secret, ownerReference, keys)
+
+		hash := certContentHash(sqlSslCert.Status)
+		if secret.Annotations[certHashAnnotation] != hash {
+			generation, _ := strconv.Atoi(secret.Annotations[certGenerationAnnotation])
+			secret.Annotations[certGenerationAnnotation] = strconv.Itoa(generation + 1)
+			secret.Annotations[certHashAnnotation] = hash
+			// only touched on content changes, so that reconciles of an unchanged cert don't update the secret
+			secret.Annotations[lastUpdatedAnnotation] = clockNow(r.Clock).Format(time.RFC3339)
+			logger.Info("Certificate content changed", "generation", generation+1)
 		}
 
 		return nil
@@ -144,44 +389,75 @@ func (r *SQLSSLCertReconciler) reconcileSQLSSLCert(ctx context.Context, req ctrl
 		return temporaryFailureError(err)
 	}
 
+	if r.StrictOwnership && len(driftedLabels) > 0 {
+		reportLabelDrift(ctx, r.Recorder, sqlSslCert, secret, driftedLabels)
+	}
+
 	logger.Info("Secret reconciled", "operation", op)
 	return nil
 }
 
-func (r *SQLSSLCertReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	return ctrl.NewControllerManagedBy(mgr).
-		For(&v1beta1.SQLSSLCert{}).
-		Complete(r)
+// splitSecretName returns the name of the secret holding only the given key, when secrets are split.
+func splitSecretName(secretName, key string) string {
+	return secretName + "-" + splitSecretSuffixes[key]
 }
 
-func decodePrivateKeyPem(in []byte) ([]byte, error) {
-	for {
-		var block *pem.Block
-		block, in = pem.Decode(in)
-		if block == nil {
-			return nil, errors.New("failed to decode PEM block")
-		}
-		if block.Type == "RSA PRIVATE KEY" {
-			return block.Bytes, nil
-		}
+// setSecretString sets the key through StringData, unless Data already holds the value.
+// StringData is write only, so setting it unconditionally would make every reconcile an update.
+func setSecretString(secret *core_v1.Secret, key, value string) {
+	if existing, ok := secret.Data[key]; ok && string(existing) == value {
+		return
 	}
+	secret.StringData[key] = value
 }
 
-func pemToPkcs8Der(pem string) ([]byte, error) {
-	der, err := decodePrivateKeyPem([]byte(pem))
-	if err != nil {
-		return nil, err
+// certContentHash returns a digest of the certificate material, used to detect rotations.
+func certContentHash(status v1beta1.SQLSSLCertStatus) string {
+	h := sha256.New()
+	for _, v := range []*string{status.Cert, status.PrivateKey, status.ServerCaCert} {
+		h.Write([]byte(ptr.Deref(v, "")))
+		h.Write([]byte{0})
 	}
+	return hex.EncodeToString(h.Sum(nil))
+}
 
-	rsaKey, err := x509.ParsePKCS1PrivateKey(der)
-	if err != nil {
-		return nil, err
-	}
+// certsExpiringSoonMetric counts the certs of the reconciled SQLSSLCerts expiring within the threshold. It is
+// computed when scraped, so that it stays current between reconciles.
+func (r *SQLSSLCertReconciler) certsExpiringSoonMetric() prometheus.GaugeFunc {
+	return prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "sqeletor_certs_expiring_soon",
+		Help: "Number of SQLSSLCert certificates expiring within the configured threshold, including expired ones",
+	}, func() float64 {
+		threshold := r.CertExpiryThreshold
+		if threshold <= 0 {
+			threshold = DefaultCertExpiryThreshold
+		}
+		return float64(r.certExpiries.expiringWithin(clockNow(r.Clock), threshold))
+	})
+}
 
-	pkcs8WrappedRsaKey, err := x509.MarshalPKCS8PrivateKey(rsaKey)
-	if err != nil {
-		return nil, err
+func (r *SQLSSLCertReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	if err := metrics.Registry.Register(r.certsExpiringSoonMetric()); err != nil {
+		return fmt.Errorf("registering cert expiry metric: %w", err)
 	}
+	b := ctrl.NewControllerManagedBy(mgr).
+		For(&v1beta1.SQLSSLCert{}, builder.WithPredicates(labelSelectorPredicate(r.LabelSelector), relevantChangePredicate(certStatusChangedPredicate())))
+	return watchTriggered(b, r.Trigger, v1beta1.SQLSSLCertGVK, r.LabelSelector).Complete(r)
+}
 
-	return pkcs8WrappedRsaKey, nil
+// certStatusChangedPredicate passes updates changing the certificate in the status, which is written to the secret.
+func certStatusChangedPredicate() predicate.Predicate {
+	return predicate.Funcs{
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			oldCert, ok := e.ObjectOld.(*v1beta1.SQLSSLCert)
+			if !ok {
+				return false
+			}
+			newCert, ok := e.ObjectNew.(*v1beta1.SQLSSLCert)
+			if !ok {
+				return false
+			}
+			return certContentHash(oldCert.Status) != certContentHash(newCert.Status)
+		},
+	}
 }
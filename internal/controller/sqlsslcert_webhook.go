@@ -0,0 +1,80 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/GoogleCloudPlatform/k8s-config-connector/pkg/clients/generated/apis/sql/v1beta1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// SQLSSLCertValidator rejects SQLSSLCerts whose secret name is already claimed by another SQLSSLCert in the
+// namespace. Both would fail the ownership check against each other, so this surfaces the conflict at apply time.
+type SQLSSLCertValidator struct {
+	Client client.Reader
+	// LabelSelector limits the validation to the certs the controller reconciles, if set.
+	LabelSelector labels.Selector
+}
+
+var _ admission.CustomValidator = &SQLSSLCertValidator{}
+
+func (v *SQLSSLCertValidator) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(&v1beta1.SQLSSLCert{}).
+		WithValidator(v).
+		Complete()
+}
+
+func (v *SQLSSLCertValidator) ValidateCreate(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
+	return nil, v.validateSecretName(ctx, obj)
+}
+
+func (v *SQLSSLCertValidator) ValidateUpdate(ctx context.Context, oldObj, newObj runtime.Object) (admission.Warnings, error) {
+	oldCert, ok := oldObj.(*v1beta1.SQLSSLCert)
+	if !ok {
+		return nil, fmt.Errorf("expected a SQLSSLCert, got %T", oldObj)
+	}
+	newCert, ok := newObj.(*v1beta1.SQLSSLCert)
+	if !ok {
+		return nil, fmt.Errorf("expected a SQLSSLCert, got %T", newObj)
+	}
+	// certs that already conflict must still be updatable, to be fixed, and deleted through the finalizer
+	if !newCert.DeletionTimestamp.IsZero() || oldCert.Annotations["sqeletor.nais.io/secret-name"] == newCert.Annotations["sqeletor.nais.io/secret-name"] {
+		return nil, nil
+	}
+	return nil, v.validateSecretName(ctx, newObj)
+}
+
+func (v *SQLSSLCertValidator) ValidateDelete(context.Context, runtime.Object) (admission.Warnings, error) {
+	return nil, nil
+}
+
+func (v *SQLSSLCertValidator) validateSecretName(ctx context.Context, obj runtime.Object) error {
+	sqlSslCert, ok := obj.(*v1beta1.SQLSSLCert)
+	if !ok {
+		return fmt.Errorf("expected a SQLSSLCert, got %T", obj)
+	}
+	secretName := sqlSslCert.Annotations["sqeletor.nais.io/secret-name"]
+	if secretName == "" || !selectorMatches(v.LabelSelector, sqlSslCert) {
+		return nil
+	}
+
+	sqlSslCerts := &v1beta1.SQLSSLCertList{}
+	if err := v.Client.List(ctx, sqlSslCerts, client.InNamespace(sqlSslCert.Namespace)); err != nil {
+		return fmt.Errorf("listing SQLSSLCerts: %w", err)
+	}
+	for _, other := range sqlSslCerts.Items {
+		// a cert being deleted is about to release the secret
+		if other.Name == sqlSslCert.Name || !other.DeletionTimestamp.IsZero() || !selectorMatches(v.LabelSelector, &other) {
+			continue
+		}
+		if other.Annotations["sqeletor.nais.io/secret-name"] == secretName {
+			return fmt.Errorf("secret %s is already claimed by SQLSSLCert %s", secretName, other.Name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package controller
+
+import (
+	"context"
+
+	"github.com/GoogleCloudPlatform/k8s-config-connector/pkg/clients/generated/apis/sql/v1beta1"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+var _ = Describe("SQLSSLCert Validator", func() {
+	ctx := context.Background()
+
+	newCert := func(name, namespace, secretName string) *v1beta1.SQLSSLCert {
+		cert := &v1beta1.SQLSSLCert{ObjectMeta: meta_v1.ObjectMeta{Name: name, Namespace: namespace}}
+		if secretName != "" {
+			cert.Annotations = map[string]string{"sqeletor.nais.io/secret-name": secretName}
+		}
+		return cert
+	}
+
+	var validator *SQLSSLCertValidator
+
+	BeforeEach(func() {
+		utilruntime.Must(v1beta1.AddToScheme(scheme.Scheme))
+		existing := newCert("existing-cert", "default", "shared-secret")
+		validator = &SQLSSLCertValidator{
+			Client: fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(existing).Build(),
+		}
+	})
+
+	It("should reject a cert claiming a secret name already claimed in the namespace", func() {
+		_, err := validator.ValidateCreate(ctx, newCert("new-cert", "default", "shared-secret"))
+		Expect(err).To(MatchError(ContainSubstring("already claimed by SQLSSLCert existing-cert")))
+	})
+
+	It("should reject an update changing the secret name to one already claimed", func() {
+		_, err := validator.ValidateUpdate(ctx, newCert("new-cert", "default", "own-secret"), newCert("new-cert", "default", "shared-secret"))
+		Expect(err).To(MatchError(ContainSubstring("already claimed")))
+	})
+
+	It("should allow updates to the cert already claiming the secret name", func() {
+		existing := newCert("existing-cert", "default", "shared-secret")
+		_, err := validator.ValidateUpdate(ctx, existing, existing)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("should allow updates to a cert already conflicting that keep its secret name", func() {
+		conflicting := newCert("conflicting-cert", "default", "shared-secret")
+		updated := conflicting.DeepCopy()
+		updated.Labels = map[string]string{"team": "a"}
+		_, err := validator.ValidateUpdate(ctx, conflicting, updated)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("should allow updates to a conflicting cert being deleted", func() {
+		conflicting := newCert("conflicting-cert", "default", "other-secret")
+		deleting := newCert("conflicting-cert", "default", "shared-secret")
+		deleting.Finalizers = []string{secretCleanupFinalizer}
+		deleting.DeletionTimestamp = ptr.To(meta_v1.Now())
+		_, err := validator.ValidateUpdate(ctx, conflicting, deleting)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("should only validate certs matching the label selector against each other", func() {
+		validator.LabelSelector = labels.SelectorFromSet(labels.Set{"tenant": "a"})
+
+		_, err := validator.ValidateCreate(ctx, newCert("new-cert", "default", "shared-secret"))
+		Expect(err).ToNot(HaveOccurred())
+
+		selected := newCert("new-cert", "default", "shared-secret")
+		selected.Labels = map[string]string{"tenant": "a"}
+		_, err = validator.ValidateCreate(ctx, selected)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("should allow the same secret name in another namespace", func() {
+		_, err := validator.ValidateCreate(ctx, newCert("new-cert", "other", "shared-secret"))
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("should allow certs without a secret name", func() {
+		_, err := validator.ValidateCreate(ctx, newCert("new-cert", "default", ""))
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("should allow claiming the secret name of a cert being deleted", func() {
+		deleting := newCert("deleting-cert", "default", "released-secret")
+		deleting.Finalizers = []string{secretCleanupFinalizer}
+		deleting.DeletionTimestamp = ptr.To(meta_v1.Now())
+		validator.Client = fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(deleting).Build()
+
+		_, err := validator.ValidateCreate(ctx, newCert("new-cert", "default", "released-secret"))
+		Expect(err).ToNot(HaveOccurred())
+	})
+})
@@ -3,35 +3,168 @@ package controller
 import (
 	"context"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"maps"
 	"net"
 	"net/url"
+	"path"
 	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
+	"unicode"
 
-	nais_io_v1alpha1 "github.com/nais/liberator/pkg/apis/nais.io/v1alpha1"
 	"github.com/prometheus/client_golang/prometheus"
 	core_v1 "k8s.io/api/core/v1"
 	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
-	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/utils/clock"
+	"k8s.io/utils/ptr"
 	"sigs.k8s.io/controller-runtime/pkg/metrics"
 
 	"github.com/GoogleCloudPlatform/k8s-config-connector/pkg/clients/generated/apis/sql/v1beta1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 )
 
+const (
+	fileKeysAnnotation = "sqeletor.nais.io/file-keys"
+	// csiKeysAnnotation writes the keys again under the env var prefix, like app.jdbc-url, for CSI drivers and
+	// projected volumes mounting the files of several users side by side. The keys are mounted as files named like
+	// the key, so mounting them as app/jdbc-url and admin/jdbc-url takes an items[].path mapping in the volume
+	csiKeysAnnotation  = "sqeletor.nais.io/csi-keys"
+	emitURLsAnnotation = "sqeletor.nais.io/emit-urls"
+	sslModeAnnotation  = "sqeletor.nais.io/ssl-mode"
+	// passwordKeyAnnotation records which key the password was written to, so it can be carried over if the key is
+	// renamed. Users sharing a secret record it per user.
+	passwordKeyAnnotation = "sqeletor.nais.io/password-key"
+	// passwordSourceSecretAnnotation references a <secret>/<key> in the same namespace to seed the password from
+	passwordSourceSecretAnnotation = "sqeletor.nais.io/password-source-secret"
+	// externalPasswordAnnotation tells us the password is supplied externally in the secret, and must not be generated
+	externalPasswordAnnotation = "sqeletor.nais.io/external-password"
+	// mountPathAnnotation tells tooling where the certificate files referenced by the secret are expected to be mounted
+	mountPathAnnotation = "sqeletor.nais.io/mount-path"
+	// resolvedInstanceAnnotation records the namespace/name of the instance the host was resolved from
+	resolvedInstanceAnnotation = "sqeletor.nais.io/resolved-instance"
+	// contentHashAnnotation holds a digest of the keys we write, for apps to template into pod annotations to roll out on change
+	contentHashAnnotation = "sqeletor.nais.io/content-hash"
+	// passwordTTLAnnotation is a duration after which generated passwords are replaced
+	passwordTTLAnnotation       = "sqeletor.nais.io/password-ttl"
+	passwordExpiresAtAnnotation = "sqeletor.nais.io/password-expires-at"
+	// previousPasswordRetentionAnnotation is a duration to keep the replaced password around after a rotation,
+	// for connection pools to drain connections made with it
+	previousPasswordRetentionAnnotation = "sqeletor.nais.io/previous-password-retention"
+	passwordRotatedAtAnnotation         = "sqeletor.nais.io/password-rotated-at"
+	// emitDotenvAnnotation enables a key holding all the other keys in dotenv format, for local development
+	emitDotenvAnnotation = "sqeletor.nais.io/emit-dotenv"
+	// jdbcPropertiesAnnotation enables discrete JDBC keys, for frameworks configured with properties rather than a URL
+	jdbcPropertiesAnnotation = "sqeletor.nais.io/jdbc-properties"
+	// poolerHostAnnotation and poolerPortAnnotation point at a connection pooler, like PgBouncer, in front of the instance
+	poolerHostAnnotation = "sqeletor.nais.io/pooler-host"
+	poolerPortAnnotation = "sqeletor.nais.io/pooler-port"
+	// readonlyURLAnnotation enables a url whose sessions default to read only transactions, for read paths
+	readonlyURLAnnotation = "sqeletor.nais.io/readonly-url"
+	// envVarPrefixAnnotation sets the prefix of the user's keys, which defaults to one derived from the resource name
+	envVarPrefixAnnotation = "sqeletor.nais.io/env-var-prefix"
+	// normalizePrefixAnnotation turns an env var prefix like my-app into MY_APP, instead of rejecting it
+	normalizePrefixAnnotation = "sqeletor.nais.io/normalize-prefix"
+	// urlCredentialsAnnotation and jdbcURLCredentialsAnnotation leave the credentials out of the postgres and jdbc urls
+	urlCredentialsAnnotation     = "sqeletor.nais.io/url-credentials"
+	jdbcURLCredentialsAnnotation = "sqeletor.nais.io/jdbc-url-credentials"
+	// targetSessionAttrsAnnotation selects which hosts libpq connects to, for clients doing their own failover
+	targetSessionAttrsAnnotation = "sqeletor.nais.io/target-session-attrs"
+	// sslNegotiationAnnotation lets libpq 17 clients start TLS directly, saving a round trip on connect
+	sslNegotiationAnnotation = "sqeletor.nais.io/ssl-negotiation"
+	sslNegotiationPostgres   = "postgres"
+	sslNegotiationDirect     = "direct"
+	// serviceAccountAnnotation names the ServiceAccount meant to mount the secret, for policy controllers to enforce.
+	// It is copied to the secret, and also as a label when serviceAccountLabelAnnotation is true. Users sharing a secret
+	// record it per user, and can only label the secret with the same one.
+	serviceAccountAnnotation      = "sqeletor.nais.io/service-account"
+	serviceAccountLabelAnnotation = "sqeletor.nais.io/service-account-label"
+
+	sslModeVerifyCA   = "verify-ca"
+	sslModeVerifyFull = "verify-full"
+	sslModeRequire    = "require"
+	// sslModeDisable is used when connecting through the Cloud SQL Auth Proxy, which encrypts the connection itself,
+	// and otherwise only for testing where the defaults allow it
+	sslModeDisable = "disable"
+)
+
+const (
+	postgresPort       = "5432"
+	postgresPortNumber = 5432
+)
+
+const (
+	// authProxyAnnotation marks an instance which clients connect to through the Cloud SQL Auth Proxy
+	authProxyAnnotation   = "sqeletor.nais.io/auth-proxy"
+	iamAuthenticationFlag = "cloudsql.iam_authentication"
+	// authProxyHost is where the Cloud SQL Auth Proxy listens, running alongside the app
+	authProxyHost = "127.0.0.1"
+
+	// connectionModeAnnotation selects between connecting over tcp, the default, or a unix socket of the auth proxy
+	connectionModeAnnotation = "sqeletor.nais.io/connection-mode"
+	connectionModeTCP        = "tcp"
+	connectionModeUnixSocket = "unix-socket"
+	// hostIPTypeAnnotation selects which ip of the instance clients connect to, the private ip by default
+	hostIPTypeAnnotation = "sqeletor.nais.io/host-ip-type"
+	hostIPTypePrivate    = "PRIVATE"
+	hostIPTypePrimary    = "PRIMARY"
+	// unixSocketDir is where the auth proxy creates a socket directory per instance connection name
+	unixSocketDir = "/cloudsql"
+)
+
+// maxDatabaseNameLength is the longest identifier postgres accepts, longer names are silently truncated
+const maxDatabaseNameLength = 63
+
+// envVarPrefixPattern matches prefixes that are valid env var names
+var envVarPrefixPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// defaultMaxURLLength is a conservative limit, above which some clients and frameworks truncate or reject URLs
+const defaultMaxURLLength = 2048
+
+var supportedSSLModes = []string{sslModeVerifyCA, sslModeVerifyFull, sslModeRequire}
+
+// targetServerTypes maps the libpq target_session_attrs values to the closest pgjdbc targetServerType
+var targetServerTypes = map[string]string{
+	"any":            "any",
+	"read-write":     "primary",
+	"primary":        "primary",
+	"read-only":      "secondary",
+	"standby":        "secondary",
+	"prefer-standby": "preferSecondary",
+}
+
+const (
+	postgresJDBCDriver = "org.postgresql.Driver"
+	mysqlJDBCDriver    = "com.mysql.cj.jdbc.Driver"
+)
+
 type UrlData struct {
 	Host         string
+	SocketDir    string
 	Username     string
 	Password     string
 	Database     string
+	SSLMode      string
 	CertPath     string
 	KeyPath      string
 	RootCertPath string
@@ -39,34 +172,126 @@ type UrlData struct {
 
 var userRequeuesMetric = prometheus.NewCounter(prometheus.CounterOpts{
 	Name: "sqluser_requeues",
-	Help: "Number of requeues for SQLUser",
+	Help: "Deprecated: use sqeletor_reconcile_total{result=\"requeue\"}. Number of requeues for SQLUser",
+})
+
+var missingPasswordMetric = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "sqluser_missing_password_total",
+	Help: "Number of SQLUser reconciles waiting for an externally supplied password",
 })
 
+// errMissingPassword is returned when a password we expect to be supplied externally is missing
+var errMissingPassword = errors.New("missing external password")
+
 func init() {
-	metrics.Registry.MustRegister(userRequeuesMetric)
+	metrics.Registry.MustRegister(userRequeuesMetric, missingPasswordMetric)
 }
 
 // SQLUserReconciler reconciles a SQLUser object
 type SQLUserReconciler struct {
 	client.Client
-	Scheme *runtime.Scheme
+	Scheme        *runtime.Scheme
+	Recorder      record.EventRecorder
+	LabelSelector labels.Selector
+	Defaults      *DefaultsHolder
+	// MaxURLLength is the length above which generated URLs are warned about, defaults to defaultMaxURLLength.
+	MaxURLLength int
+	// NamespaceTeamLabel is the namespace label holding the team, used when the SQLUser has no team label. Defaults to "team".
+	NamespaceTeamLabel string
+	// StrictOwnership reports managed labels that were changed externally, in addition to resetting them.
+	StrictOwnership bool
+	// ResourceMetricLabels labels the reconcile metrics with the team and app of the resource.
+	ResourceMetricLabels bool
+	// NoOwnerReferences records the owner of the secret in an annotation instead of an owner reference, and cleans
+	// up the secret using a finalizer. For secrets also tracked by GitOps tools, which conflict with foreign owners.
+	NoOwnerReferences bool
+	// Clock is used for timestamps and password expiry, defaults to the real clock.
+	Clock clock.PassiveClock
+	// Trigger enqueues reconciles requested through the admin endpoint, if set.
+	Trigger *ReconcileTrigger
+	// LegacyValidation keeps accepting env var prefixes that aren't valid env var names, as earlier releases did, with
+	// a warning event.
+	LegacyValidation bool
+
+	warnings reportedWarnings
+}
+
+// reportedWarnings remembers the warnings last reported for each resource, so that a lasting problem is reported
+// when it appears or changes rather than on every reconcile. It is safe for concurrent use, as reconciles can run
+// concurrently.
+type reportedWarnings struct {
+	mu       sync.Mutex
+	messages map[reportedWarning]string
+}
+
+// reportedWarning identifies a problem of a resource, usually by the reason of the event reporting it.
+type reportedWarning struct {
+	key   types.NamespacedName
+	topic string
+}
+
+// report records the message for the problem of the resource, and reports whether it differs from the one reported
+// before.
+func (w *reportedWarnings) report(key types.NamespacedName, topic, message string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.messages == nil {
+		w.messages = make(map[reportedWarning]string)
+	}
+	warning := reportedWarning{key: key, topic: topic}
+	if reported, ok := w.messages[warning]; ok && reported == message {
+		return false
+	}
+	w.messages[warning] = message
+	return true
+}
+
+// resolve forgets the problem of the resource, so that it is reported again should it come back.
+func (w *reportedWarnings) resolve(key types.NamespacedName, topic string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.messages, reportedWarning{key: key, topic: topic})
+}
+
+// forget forgets all problems of the resource, once it is gone.
+func (w *reportedWarnings) forget(key types.NamespacedName) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for warning := range w.messages {
+		if warning.key == key {
+			delete(w.messages, warning)
+		}
+	}
 }
 
 func (r *SQLUserReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 	logger := log.FromContext(ctx)
+	start := time.Now()
 
-	err := r.reconcileSQLUser(ctx, req)
+	// filled in by the reconcile, and left empty if the user is gone
+	sqlUser := &v1beta1.SQLUser{}
+	requeueAfter, err := r.reconcileSQLUser(ctx, req, sqlUser)
+	resource := metricResourceLabels(r.ResourceMetricLabels, sqlUser)
 	if errors.Is(err, errTemporaryFailure) {
 		userRequeuesMetric.Inc()
+		if errors.Is(err, errMissingPassword) {
+			missingPasswordMetric.Inc()
+		}
+		observeRequeue("SQLUser", err)
+		observeReconcile("SQLUser", reconcileResultRequeue, start, resource)
 		logger.Error(err, "requeueing after temporary failure")
 		return ctrl.Result{
-			RequeueAfter: time.Minute,
+			RequeueAfter: requeueInterval(ctx, sqlUser),
 		}, nil
 	}
 	if err != nil {
+		observeReconcile("SQLUser", reconcileResultError, start, resource)
 		logger.Error(err, "failed to reconcile SQLUser")
+		return ctrl.Result{}, err
 	}
-	return ctrl.Result{}, err
+	observeReconcile("SQLUser", reconcileResultSuccess, start, resource)
+	lastSuccessfulReconcileMetric.WithLabelValues("SQLUser").SetToCurrentTime()
+	return ctrl.Result{RequeueAfter: requeueAfter}, nil
 }
 
 func validateSecretKeyRef(sqlUser *v1beta1.SQLUser) error {
@@ -80,41 +305,247 @@ func validateSecretKeyRef(sqlUser *v1beta1.SQLUser) error {
 	return nil
 }
 
-func (r *SQLUserReconciler) getInstancePrivateIP(ctx context.Context, key types.NamespacedName) (string, error) {
+func (r *SQLUserReconciler) getInstance(ctx context.Context, key types.NamespacedName) (*v1beta1.SQLInstance, error) {
 	sqlInstance := &v1beta1.SQLInstance{}
-	if err := r.Client.Get(ctx, key, sqlInstance); err != nil {
-		return "", temporaryFailureError(fmt.Errorf("failed to get SQLInstance: %w", err))
+	// transient api errors are retried right away, which is cheaper than requeueing the whole reconcile
+	err := retry.OnError(retry.DefaultBackoff, isTransientAPIError, func() error {
+		return r.Client.Get(ctx, key, sqlInstance)
+	})
+	if err != nil {
+		return nil, temporaryFailureError(fmt.Errorf("failed to get SQLInstance: %w", err))
+	}
+	return sqlInstance, nil
+}
+
+// instancePrivateIP returns the private ip of the instance, falling back to the annotated ip of its Private Service
+// Connect endpoint for instances only reachable through PSC. The dns name of such an instance isn't used in its stead,
+// as the network policy of the instance can only allow egress to the endpoint once its ip is annotated.
+func instancePrivateIP(sqlInstance *v1beta1.SQLInstance) (string, error) {
+	// instances on a shared VPC report a private ip without necessarily referencing the network in the spec
+	if privateIP := ptr.Deref(sqlInstance.Status.PrivateIpAddress, ""); privateIP != "" {
+		return privateIP, nil
 	}
-	if sqlInstance.Spec.Settings.IpConfiguration.PrivateNetworkRef == nil {
+
+	ipConfiguration := sqlInstance.Spec.Settings.IpConfiguration
+	if ipConfiguration == nil {
 		return "", permanentFailureError(fmt.Errorf("referenced sql instance is not configured for private ip"))
 	}
-	if sqlInstance.Status.PrivateIpAddress == nil || *sqlInstance.Status.PrivateIpAddress == "" {
-		return "", temporaryFailureError(fmt.Errorf("referenced sql instance does not have a private ip"))
+	if ipConfiguration.PrivateNetworkRef != nil {
+		return "", temporaryFailureErrorFor(reasonWaitingForInstanceIP, fmt.Errorf("referenced sql instance does not have a private ip"))
+	}
+	if pscEnabled(ipConfiguration) {
+		if pscEndpoint := sqlInstance.Annotations[pscEndpointAnnotation]; pscEndpoint != "" {
+			return pscEndpoint, nil
+		}
+		return "", temporaryFailureErrorFor(reasonWaitingForInstanceIP, fmt.Errorf("referenced sql instance is only reachable through private service connect, and the ip of its endpoint is not annotated with %s", pscEndpointAnnotation))
+	}
+	return "", permanentFailureError(fmt.Errorf("referenced sql instance is not configured for private ip"))
+}
+
+// instanceHost returns the host clients connect to. This is the private ip of the instance, or the Cloud SQL Auth
+// Proxy on localhost for instances without one that are connected to through the proxy.
+func instanceHost(sqlInstance *v1beta1.SQLInstance) (host string, viaAuthProxy bool, err error) {
+	privateIP, err := instancePrivateIP(sqlInstance)
+	if errors.Is(err, errPermanentFailure) && usesAuthProxy(sqlInstance) {
+		if err := authProxyEgress(sqlInstance); err != nil {
+			return "", false, err
+		}
+		return authProxyHost, true, nil
+	}
+	return privateIP, false, err
+}
+
+// authProxyEgress refuses connecting through the auth proxy to an instance without a private ip, unless its network
+// policy allows egress to the public ip the proxy connects to instead.
+func authProxyEgress(sqlInstance *v1beta1.SQLInstance) error {
+	if _, err := instancePrivateIP(sqlInstance); !errors.Is(err, errPermanentFailure) || instancePublicIPEgress(sqlInstance) {
+		return nil
+	}
+	return permanentFailureError(fmt.Errorf("referenced sql instance has no private ip, and does not allow egress to the public ip the auth proxy connects to, set %s=true on it", publicIPEgressAnnotation))
+}
+
+// instancePrimaryIP returns the primary, public, ip of the instance.
+func instancePrimaryIP(sqlInstance *v1beta1.SQLInstance) (string, error) {
+	for _, ip := range sqlInstance.Status.IpAddress {
+		if ptr.Deref(ip.Type, "") == hostIPTypePrimary && ptr.Deref(ip.IpAddress, "") != "" {
+			return *ip.IpAddress, nil
+		}
+	}
+	ipConfiguration := sqlInstance.Spec.Settings.IpConfiguration
+	if ipConfiguration != nil && !ptr.Deref(ipConfiguration.Ipv4Enabled, true) {
+		return "", permanentFailureError(fmt.Errorf("referenced sql instance is not configured for public ip"))
 	}
-	return *sqlInstance.Status.PrivateIpAddress, nil
+	return "", temporaryFailureErrorFor(reasonWaitingForInstanceIP, fmt.Errorf("referenced sql instance does not have a primary ip"))
 }
 
-func (r *SQLUserReconciler) reconcileSQLUser(ctx context.Context, req ctrl.Request) error {
+// userInstanceHost returns the host the user connects to, and whether that is through the auth proxy. This is the
+// socket directory in unix socket mode, or else the ip selected by the host ip type annotation.
+func userInstanceHost(sqlUser *v1beta1.SQLUser, sqlInstance *v1beta1.SQLInstance) (host string, viaAuthProxy bool, err error) {
+	unixSocket, err := userUnixSocket(sqlUser)
+	if err != nil {
+		return "", false, err
+	}
+	if unixSocket {
+		socketDir, err := instanceSocketDir(sqlInstance)
+		if err != nil {
+			return "", false, err
+		}
+		if err := authProxyEgress(sqlInstance); err != nil {
+			return "", false, err
+		}
+		return socketDir, true, nil
+	}
+	switch ipType := sqlUser.Annotations[hostIPTypeAnnotation]; ipType {
+	case "", hostIPTypePrivate:
+		return instanceHost(sqlInstance)
+	case hostIPTypePrimary:
+		// the network policy of the instance would block the connection
+		if !instancePublicIPEgress(sqlInstance) {
+			return "", false, permanentFailureError(fmt.Errorf("referenced sql instance does not allow egress to its public ip, set %s=true on it", publicIPEgressAnnotation))
+		}
+		primaryIP, err := instancePrimaryIP(sqlInstance)
+		return primaryIP, false, err
+	default:
+		return "", false, permanentFailureError(fmt.Errorf("unsupported host ip type %q in annotation %s", ipType, hostIPTypeAnnotation))
+	}
+}
+
+// userUnixSocket reports whether the user connects through a unix socket of the auth proxy.
+func userUnixSocket(sqlUser *v1beta1.SQLUser) (bool, error) {
+	switch mode := sqlUser.Annotations[connectionModeAnnotation]; mode {
+	case "", connectionModeTCP:
+		return false, nil
+	case connectionModeUnixSocket:
+		return true, nil
+	default:
+		return false, permanentFailureError(fmt.Errorf("unsupported connection mode %q in annotation %s", mode, connectionModeAnnotation))
+	}
+}
+
+// instanceSocketDir returns the directory the auth proxy creates the unix socket of the instance in.
+func instanceSocketDir(sqlInstance *v1beta1.SQLInstance) (string, error) {
+	connectionName := ptr.Deref(sqlInstance.Status.ConnectionName, "")
+	if connectionName == "" {
+		return "", temporaryFailureErrorFor(reasonWaitingForConnectionName, fmt.Errorf("referenced sql instance does not have a connection name"))
+	}
+	return path.Join(unixSocketDir, connectionName), nil
+}
+
+// instanceProject returns the GCP project of the instance, from the project:region:name connection name in its
+// status or else the Config Connector project annotation, in the same order as instanceConnectionName. Returns an
+// empty string if neither is known.
+func instanceProject(sqlInstance *v1beta1.SQLInstance) string {
+	if project, _, found := strings.Cut(ptr.Deref(sqlInstance.Status.ConnectionName, ""), ":"); found && project != "" {
+		return project
+	}
+	return sqlInstance.Annotations[cnrmProjectIDAnnotation]
+}
+
+// instancePostgres reports whether the instance runs postgres, resolved from its database version. Instances without
+// a database version are assumed to run postgres.
+func instancePostgres(sqlInstance *v1beta1.SQLInstance) bool {
+	databaseVersion := ptr.Deref(sqlInstance.Spec.DatabaseVersion, "")
+	return databaseVersion == "" || strings.HasPrefix(databaseVersion, "POSTGRES")
+}
+
+// jdbcDriverClass returns the JDBC driver class for the engine of the instance, resolved from its database version,
+// or an empty string for engines we have no driver for.
+func jdbcDriverClass(sqlInstance *v1beta1.SQLInstance) string {
+	switch {
+	case instancePostgres(sqlInstance):
+		return postgresJDBCDriver
+	case strings.HasPrefix(ptr.Deref(sqlInstance.Spec.DatabaseVersion, ""), "MYSQL"):
+		return mysqlJDBCDriver
+	default:
+		return ""
+	}
+}
+
+// usesAuthProxy reports whether clients connect to the instance through the Cloud SQL Auth Proxy, either because the
+// instance is annotated as such or because it uses IAM database authentication.
+func usesAuthProxy(sqlInstance *v1beta1.SQLInstance) bool {
+	if boolAnnotation(sqlInstance, authProxyAnnotation, false) {
+		return true
+	}
+	for _, flag := range sqlInstance.Spec.Settings.DatabaseFlags {
+		if flag.Name == iamAuthenticationFlag && flag.Value == "on" {
+			return true
+		}
+	}
+	return false
+}
+
+// instancePSCEnabled reports whether the instance is configured for Private Service Connect.
+func instancePSCEnabled(sqlInstance *v1beta1.SQLInstance) bool {
+	ipConfiguration := sqlInstance.Spec.Settings.IpConfiguration
+	return ipConfiguration != nil && pscEnabled(ipConfiguration)
+}
+
+func pscEnabled(ipConfiguration *v1beta1.InstanceIpConfiguration) bool {
+	for _, pscConfig := range ipConfiguration.PscConfig {
+		if ptr.Deref(pscConfig.PscEnabled, false) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *SQLUserReconciler) reconcileSQLUser(ctx context.Context, req ctrl.Request, sqlUser *v1beta1.SQLUser) (time.Duration, error) {
 	logger := log.FromContext(ctx)
 
-	sqlUser := &v1beta1.SQLUser{}
 	if err := r.Client.Get(ctx, req.NamespacedName, sqlUser); err != nil {
 		if apierrors.IsNotFound(err) {
 			logger.Info("SQLUser not found, aborting reconcile")
-			return nil
+			r.warnings.forget(req.NamespacedName)
+			return 0, nil
 		}
-		return temporaryFailureError(fmt.Errorf("failed to get SQLUser: %w", err))
+		return 0, temporaryFailureError(fmt.Errorf("failed to get SQLUser: %w", err))
 	}
 
-	envVarPrefix, ok := sqlUser.Annotations["sqeletor.nais.io/env-var-prefix"]
-	if !ok {
-		logger.V(4).Info("ignoring: env var prefix annotation not found")
-		return nil
+	if !sqlUser.DeletionTimestamp.IsZero() {
+		if !controllerutil.ContainsFinalizer(sqlUser, secretCleanupFinalizer) {
+			return 0, nil
+		}
+		logger.Info("SQLUser is being deleted, cleaning up secret")
+		if validateSecretKeyRef(sqlUser) != nil {
+			return 0, cleanupSecrets(ctx, r.Client, sqlUser)
+		}
+		return 0, cleanupSecrets(ctx, r.Client, sqlUser, sqlUser.Spec.Password.ValueFrom.SecretKeyRef.Name)
+	}
+
+	if boolAnnotation(sqlUser, pausedAnnotation, false) {
+		logger.Info("SQLUser is paused, leaving secret untouched", "annotation", pausedAnnotation)
+		return 0, nil
 	}
+
 	dbName, ok := sqlUser.Annotations["sqeletor.nais.io/database-name"]
 	if !ok {
 		logger.V(4).Info("ignoring: database name annotation not found")
-		return nil
+		return 0, nil
+	}
+	if err := validateDatabaseName(dbName); err != nil {
+		return 0, permanentFailureError(err)
+	}
+	envVarPrefix := userEnvVarPrefix(sqlUser)
+	if annotated, ok := sqlUser.Annotations[envVarPrefixAnnotation]; !ok {
+		logger.Info("Env var prefix annotation not found, derived prefix from name", "envVarPrefix", envVarPrefix)
+		message := fmt.Sprintf("No env var prefix annotation, using %s derived from the resource name", envVarPrefix)
+		if r.warnings.report(req.NamespacedName, "DerivedEnvVarPrefix", message) {
+			r.Recorder.Event(sqlUser, core_v1.EventTypeNormal, "DerivedEnvVarPrefix", message)
+		}
+	} else {
+		r.warnings.resolve(req.NamespacedName, "DerivedEnvVarPrefix")
+		if annotated != envVarPrefix {
+			logger.Info("Normalized env var prefix", "envVarPrefix", annotated, "normalizedEnvVarPrefix", envVarPrefix)
+		}
+	}
+	// derived and normalized prefixes are valid by construction, but are checked all the same
+	if !envVarPrefixPattern.MatchString(envVarPrefix) {
+		if !r.LegacyValidation {
+			r.Recorder.Eventf(sqlUser, core_v1.EventTypeWarning, "InvalidEnvVarPrefix", "Env var prefix %q is not a valid env var name, set %s=true to normalize it", envVarPrefix, normalizePrefixAnnotation)
+			return 0, permanentFailureError(fmt.Errorf("invalid env var prefix %q", envVarPrefix))
+		}
+		r.Recorder.Eventf(sqlUser, core_v1.EventTypeWarning, "InvalidEnvVarPrefix", "Env var prefix %q is not a valid env var name and will be rejected once legacy validation is removed, set %s=true to normalize it", envVarPrefix, normalizePrefixAnnotation)
 	}
 
 	logger.Info("Reconciling SQLUser")
@@ -122,29 +553,163 @@ func (r *SQLUserReconciler) reconcileSQLUser(ctx context.Context, req ctrl.Reque
 	logger = logger.WithValues("envVarPrefix", envVarPrefix, "databaseName", dbName)
 
 	if err := validateSecretKeyRef(sqlUser); err != nil {
-		return permanentFailureError(err)
+		return 0, permanentFailureError(err)
+	}
+	serviceAccount, hasServiceAccount := sqlUser.Annotations[serviceAccountAnnotation]
+	labelServiceAccount := hasServiceAccount && boolAnnotation(sqlUser, serviceAccountLabelAnnotation, false)
+	if hasServiceAccount {
+		if err := validateServiceAccountName(serviceAccount, labelServiceAccount); err != nil {
+			r.Recorder.Event(sqlUser, core_v1.EventTypeWarning, "InvalidServiceAccount", err.Error())
+			return 0, permanentFailureError(err)
+		}
 	}
 	secretName := sqlUser.Spec.Password.ValueFrom.SecretKeyRef.Name
 	secretKey := sqlUser.Spec.Password.ValueFrom.SecretKeyRef.Key
-	logger = logger.WithValues("secretName", secretName, "secretKey", secretKey)
+	// the secret is always created alongside the SQLUser, as owner references can't cross namespaces
+	logger = logger.WithValues("secretName", secretName, "secretKey", secretKey, "secretNamespace", req.Namespace)
 
 	namespace := req.Namespace
 	if sqlUser.Spec.InstanceRef.Namespace != "" {
 		namespace = sqlUser.Spec.InstanceRef.Namespace
 	}
 	instanceKey := types.NamespacedName{Name: sqlUser.Spec.InstanceRef.Name, Namespace: namespace}
-	instanceIP, err := r.getInstancePrivateIP(ctx, instanceKey)
+	sqlInstance, err := r.getInstance(ctx, instanceKey)
 	if err != nil {
-		return err
+		return 0, err
+	}
+	unixSocket, err := userUnixSocket(sqlUser)
+	if err != nil {
+		return 0, err
+	}
+	instanceIP, viaAuthProxy, err := userInstanceHost(sqlUser, sqlInstance)
+	if err != nil {
+		return 0, err
+	}
+	if !unixSocket && sqlUser.Annotations[hostIPTypeAnnotation] == hostIPTypePrimary {
+		message := fmt.Sprintf("Connecting to the public ip %s of the instance, traffic leaves the private network", instanceIP)
+		if r.warnings.report(req.NamespacedName, "PublicIP", message) {
+			r.Recorder.Event(sqlUser, core_v1.EventTypeWarning, "PublicIP", message)
+		}
+	} else {
+		r.warnings.resolve(req.NamespacedName, "PublicIP")
+	}
+	// the network policy of the instance allows egress from the pods of its app, not necessarily those of the user
+	if userApp, instanceApp := sqlUser.Labels[appKey], sqlInstance.Labels[appKey]; userApp != "" && instanceApp != "" && userApp != instanceApp {
+		logger.Info("SQLUser and SQLInstance have different app labels", "userApp", userApp, "instanceApp", instanceApp)
+		message := fmt.Sprintf("SQLUser has app label %s, but SQLInstance %s has app label %s, so its network policy does not allow egress from the pods of %s", userApp, instanceKey, instanceApp, userApp)
+		if r.warnings.report(req.NamespacedName, "AppLabelMismatch", message) {
+			r.Recorder.Event(sqlUser, core_v1.EventTypeWarning, "AppLabelMismatch", message)
+		}
+	} else {
+		r.warnings.resolve(req.NamespacedName, "AppLabelMismatch")
+	}
+	instanceRegion := ptr.Deref(sqlInstance.Spec.Region, "")
+	instanceProject := instanceProject(sqlInstance)
+	postgres := instancePostgres(sqlInstance)
+	if !postgres {
+		logger.Info("SQLInstance does not run postgres, leaving out the postgres urls", "databaseVersion", ptr.Deref(sqlInstance.Spec.DatabaseVersion, ""))
+	}
+	jdbcDriver := jdbcDriverClass(sqlInstance)
+
+	defaults := r.Defaults.Get()
+
+	sslMode, err := userSSLMode(sqlUser, defaults)
+	if err != nil {
+		return 0, err
+	}
+	if viaAuthProxy {
+		logger.Info("Connecting through the auth proxy", "host", instanceIP)
+		sslMode = sslModeDisable
+	}
+	if !viaAuthProxy && sslMode == sslModeDisable {
+		message := fmt.Sprintf("Connections to %s are not encrypted, which is only meant for testing", instanceIP)
+		if r.warnings.report(req.NamespacedName, "SSLDisabled", message) {
+			r.Recorder.Event(sqlUser, core_v1.EventTypeWarning, "SSLDisabled", message)
+		}
+	} else {
+		r.warnings.resolve(req.NamespacedName, "SSLDisabled")
+	}
+
+	poolerAddress, err := userPoolerAddress(sqlUser)
+	if err != nil {
+		return 0, err
+	}
+
+	targetSessionAttrs, hasTargetSessionAttrs := sqlUser.Annotations[targetSessionAttrsAnnotation]
+	if _, ok := targetServerTypes[targetSessionAttrs]; hasTargetSessionAttrs && !ok {
+		return 0, permanentFailureError(fmt.Errorf("unsupported target session attrs %q in annotation %s", targetSessionAttrs, targetSessionAttrsAnnotation))
+	}
+
+	if _, err := userSSLNegotiation(sqlUser); err != nil {
+		return 0, permanentFailureError(err)
+	}
+
+	secretType, err := secretTypeOf(sqlUser)
+	if err != nil {
+		return 0, err
 	}
 
 	prefixedPasswordKey := envVarPrefix + "_PASSWORD"
 	if secretKey != prefixedPasswordKey {
-		return permanentFailureError(fmt.Errorf("secret key %s does not match expected key %s", secretKey, prefixedPasswordKey))
+		return 0, permanentFailureError(fmt.Errorf("secret key %s does not match expected key %s", secretKey, prefixedPasswordKey))
+	}
+
+	sourcePassword, err := r.sourcePassword(ctx, sqlUser)
+	if err != nil {
+		return 0, err
+	}
+	externalPassword := boolAnnotation(sqlUser, externalPasswordAnnotation, false)
+
+	var passwordTTL time.Duration
+	if value, ok := sqlUser.Annotations[passwordTTLAnnotation]; ok {
+		passwordTTL, err = time.ParseDuration(value)
+		if err != nil || passwordTTL <= 0 {
+			return 0, permanentFailureError(fmt.Errorf("invalid %s annotation %q, expected a positive duration", passwordTTLAnnotation, value))
+		}
+	}
+	var previousPasswordRetention time.Duration
+	if value, ok := sqlUser.Annotations[previousPasswordRetentionAnnotation]; ok {
+		previousPasswordRetention, err = time.ParseDuration(value)
+		if err != nil || previousPasswordRetention <= 0 {
+			return 0, permanentFailureError(fmt.Errorf("invalid %s annotation %q, expected a positive duration", previousPasswordRetentionAnnotation, value))
+		}
+	}
+	now := clockNow(r.Clock)
+	var passwordExpiresAt, previousPasswordExpiresAt time.Time
+
+	team, err := resolveTeam(ctx, r.Client, sqlUser, r.NamespaceTeamLabel)
+	if err != nil {
+		return 0, err
+	}
+	if team == "" {
+		message := "Neither the SQLUser nor its namespace has a team label, the secret will not be attributed to a team"
+		if r.warnings.report(req.NamespacedName, "MissingTeam", message) {
+			r.Recorder.Event(sqlUser, core_v1.EventTypeWarning, "MissingTeam", message)
+		}
+	} else {
+		r.warnings.resolve(req.NamespacedName, "MissingTeam")
 	}
 
+	// without an owner reference, garbage collection won't delete the secret with the user
+	if r.NoOwnerReferences {
+		if err := ensureSecretCleanupFinalizer(ctx, r.Client, sqlUser); err != nil {
+			return 0, err
+		}
+	}
+
+	ownerReference, err := ownerReferenceFor(r.Scheme, sqlUser)
+	if err != nil {
+		return 0, err
+	}
+	if err := ensureSecretType(ctx, r.Client, r.Recorder, sqlUser, types.NamespacedName{Namespace: req.Namespace, Name: secretName}, ownerReference, secretType); err != nil {
+		return 0, err
+	}
+
+	var driftedLabels []string
 	secret := &core_v1.Secret{ObjectMeta: meta_v1.ObjectMeta{Namespace: req.Namespace, Name: secretName}}
-	op, err := controllerutil.CreateOrUpdate(ctx, r.Client, secret, func() error {
+	op, err := createOrUpdate(ctx, r.Client, secret, func() error {
+		driftedLabels = nil
+		isNew := secret.CreationTimestamp.IsZero()
 		if secret.Labels == nil {
 			secret.Labels = make(map[string]string)
 		}
@@ -152,56 +717,142 @@ func (r *SQLUserReconciler) reconcileSQLUser(ctx context.Context, req ctrl.Reque
 			secret.Annotations = make(map[string]string)
 		}
 
-		ownerReference := meta_v1.OwnerReference{
-			APIVersion: sqlUser.GetObjectKind().GroupVersionKind().GroupVersion().String(),
-			Kind:       sqlUser.GetObjectKind().GroupVersionKind().Kind,
-			Name:       sqlUser.GetName(),
-			UID:        sqlUser.GetUID(),
-		}
-
-		// if new resource, add owner reference and managed-by label
+		// if new resource, add managed-by label
 		// the secret is owned by the sql user.
-		if secret.CreationTimestamp.IsZero() {
-			secret.OwnerReferences = []meta_v1.OwnerReference{ownerReference}
+		if isNew {
 			secret.Labels[managedByKey] = sqeletorFqdnId
-		} else if err := validateOwnership(ownerReference, secret); err != nil {
+			secret.Type = secretType
+		} else if err := validateOwnership(ownerReference, secret, sharedSecretCoOwners(ownerReference, secret)...); err != nil {
 			return err
 		}
+		// password rotation is tracked in annotations of the secret, which can't tell users sharing it apart
+		sharedWithUser := slices.ContainsFunc(ownerReferencesOf(secret), func(existing meta_v1.OwnerReference) bool {
+			return existing.Kind == ownerReference.Kind && existing.Name != ownerReference.Name
+		})
+		if sharedWithUser && (passwordTTL > 0 || previousPasswordRetention > 0) {
+			return permanentFailureError(fmt.Errorf("%s and %s are not supported for users sharing secret %s", passwordTTLAnnotation, previousPasswordRetentionAnnotation, secretName))
+		}
+		// the secret may be shared with other sql users and a sql ssl cert, in which case all are owners.
+		setOwner(ownerReference, secret, r.NoOwnerReferences)
 
-		secret.Labels[typeKey] = sqeletorFqdnId
-		secret.Labels[appKey] = sqlUser.Labels[appKey]
-		secret.Labels[teamKey] = sqlUser.Labels[teamKey]
+		drifted := setSecretLabels(secret, ownerReference, secretKindCredentials, map[string]string{
+			appKey:  sqlUser.Labels[appKey],
+			teamKey: team,
+		})
+		if !isNew {
+			driftedLabels = drifted
+		}
 
 		secret.Annotations[deploymentCorrelationIdKey] = sqlUser.Annotations[deploymentCorrelationIdKey]
-		secret.Annotations[lastUpdatedAnnotation] = time.Now().Format(time.RFC3339)
+		setSourceGeneration(secret, ownerReference, sqlUser.Generation)
+		setKindOwnerAnnotation(secret, ownerReference, resolvedInstanceAnnotation, instanceKey.String())
+		if hasServiceAccount {
+			setKindOwnerAnnotation(secret, ownerReference, serviceAccountAnnotation, serviceAccount)
+		} else {
+			deleteKindOwnerAnnotation(secret, ownerReference, serviceAccountAnnotation)
+		}
+		if labelServiceAccount {
+			setKindOwnerAnnotation(secret, ownerReference, serviceAccountLabelAnnotation, serviceAccount)
+		} else {
+			deleteKindOwnerAnnotation(secret, ownerReference, serviceAccountLabelAnnotation)
+		}
+		if err := setServiceAccountLabel(secret); err != nil {
+			return err
+		}
+		secret.Annotations[lastUpdatedAnnotation] = now.Format(time.RFC3339)
+
+		// prefer a seeded password, then the one already in the secret, and only generate if neither exists
+		currentPassword := string(secret.Data[prefixedPasswordKey])
+		// the password key follows the env var prefix, so migrate the existing password rather than generating a new one.
+		// In a shared secret the previous key may be the password of another user, which is left alone.
+		previousKey := kindOwnerAnnotation(secret, ownerReference, passwordKeyAnnotation)
+		if previousKey != "" && previousKey != prefixedPasswordKey && !slices.Contains(otherOwnersKeys(secret, ownerReference), previousKey) {
+			if len(currentPassword) == 0 {
+				currentPassword = string(secret.Data[previousKey])
+			}
+			delete(secret.Data, previousKey)
+			delete(secret.StringData, previousKey)
+			logger.Info("Migrated password from previous key", "previousKey", previousKey)
+		}
+		setKindOwnerAnnotation(secret, ownerReference, passwordKeyAnnotation, prefixedPasswordKey)
+		password := sourcePassword
+		if len(password) == 0 {
+			password = currentPassword
+		}
 
-		password := string(secret.Data[prefixedPasswordKey])
+		// seeded and external passwords are managed by whoever supplies them, so only generated passwords expire
+		passwordExpiresAt = time.Time{}
+		if passwordTTL > 0 && len(sourcePassword) == 0 && !externalPassword {
+			expiresAt, err := time.Parse(time.RFC3339, secret.Annotations[passwordExpiresAtAnnotation])
+			if len(password) > 0 && err == nil && !now.Before(expiresAt) {
+				logger.Info("Password expired, generating a new one", "expiredAt", expiresAt)
+				password = ""
+			}
+			if len(password) == 0 || err != nil {
+				// new passwords, and existing passwords getting a TTL for the first time, expire a TTL from now
+				expiresAt = now.Add(passwordTTL)
+			}
+			passwordExpiresAt = expiresAt
+			secret.Annotations[passwordExpiresAtAnnotation] = expiresAt.Format(time.RFC3339)
+		} else {
+			delete(secret.Annotations, passwordExpiresAtAnnotation)
+		}
+		if len(password) == 0 && externalPassword {
+			// generating a password would mask that whoever supplies it hasn't done so yet
+			return temporaryFailureErrorFor(reasonWaitingForPassword, fmt.Errorf("%w: secret %s has no key %s", errMissingPassword, secretName, prefixedPasswordKey))
+		}
 		if len(password) == 0 {
 			password = generatePassword()
 		}
 
-		postgresPort := "5432"
+		// keep the replaced password for a while, so both work until connection pools have moved on
+		previousPasswordKey := envVarPrefix + "_PREVIOUS_PASSWORD"
+		previousPassword := ""
+		previousPasswordExpiresAt = time.Time{}
+		if previousPasswordRetention > 0 {
+			if len(currentPassword) > 0 && password != currentPassword {
+				logger.Info("Password rotated, retaining the previous one", "retention", previousPasswordRetention)
+				previousPassword = currentPassword
+				secret.Annotations[passwordRotatedAtAnnotation] = now.Format(time.RFC3339)
+			} else if rotatedAt, err := time.Parse(time.RFC3339, secret.Annotations[passwordRotatedAtAnnotation]); err == nil && now.Before(rotatedAt.Add(previousPasswordRetention)) {
+				previousPassword = string(secret.Data[previousPasswordKey])
+			}
+		}
+		if len(previousPassword) > 0 {
+			rotatedAt, _ := time.Parse(time.RFC3339, secret.Annotations[passwordRotatedAtAnnotation])
+			previousPasswordExpiresAt = rotatedAt.Add(previousPasswordRetention)
+		} else {
+			delete(secret.Annotations, passwordRotatedAtAnnotation)
+		}
 
-		rootCertPath := filepath.Join(nais_io_v1alpha1.DefaultSqeletorMountPath, rootCertKey)
-		certPath := filepath.Join(nais_io_v1alpha1.DefaultSqeletorMountPath, certKey)
-		pk1PemKeyPath := filepath.Join(nais_io_v1alpha1.DefaultSqeletorMountPath, pk1PemKeyKey)
-		pk8DerKeyPath := filepath.Join(nais_io_v1alpha1.DefaultSqeletorMountPath, pk8DerKeyKey)
+		mountPath := defaults.mountPath()
+		secret.Annotations[mountPathAnnotation] = mountPath
+		rootCertPath := filepath.Join(mountPath, rootCertKey)
+		certPath := filepath.Join(mountPath, certKey)
+		pk1PemKeyPath := filepath.Join(mountPath, pk1PemKeyKey)
+		pk8DerKeyPath := filepath.Join(mountPath, pk8DerKeyKey)
 
-		urlData := UrlData{
-			Host:         net.JoinHostPort(instanceIP, postgresPort),
-			Username:     *sqlUser.Spec.ResourceID,
-			Password:     password,
-			Database:     dbName,
-			CertPath:     certPath,
-			KeyPath:      pk1PemKeyPath,
-			RootCertPath: rootCertPath,
+		// the same url the connstring subcommand prints, so the two can't drift apart
+		googleSQLPostgresURL, err := ConnectionURL(sqlUser, sqlInstance, password, defaults)
+		if err != nil {
+			return permanentFailureError(err)
 		}
-		googleSQLPostgresURL := makePostgresUrl(urlData)
 
-		urlData.KeyPath = pk8DerKeyPath
+		urlData := newUrlData(instanceIP, *sqlUser.Spec.ResourceID, password, dbName, sslMode, mountPath)
+		if urlData.KeyPath != "" {
+			urlData.KeyPath = pk8DerKeyPath
+		}
 		googleSQLJDBCURL := makeJDBCUrl(urlData)
+		if hasTargetSessionAttrs {
+			googleSQLJDBCURL = withQuery(googleSQLJDBCURL, "targetServerType", targetServerTypes[targetSessionAttrs])
+		}
+
+		// clients may read the credentials from the discrete keys instead
+		if !boolAnnotation(sqlUser, jdbcURLCredentialsAnnotation, true) {
+			googleSQLJDBCURL = withoutJDBCCredentials(googleSQLJDBCURL)
+		}
 
-		secret.StringData = map[string]string{
+		envData := map[string]string{
 			prefixedPasswordKey:           password,
 			envVarPrefix + "_HOST":        instanceIP,
 			envVarPrefix + "_PORT":        postgresPort,
@@ -209,61 +860,601 @@ func (r *SQLUserReconciler) reconcileSQLUser(ctx context.Context, req ctrl.Reque
 			envVarPrefix + "_USERNAME":    *sqlUser.Spec.ResourceID,
 			envVarPrefix + "_URL":         googleSQLPostgresURL.String(),
 			envVarPrefix + "_JDBC_URL":    googleSQLJDBCURL.String(),
+			envVarPrefix + "_JDBC_DRIVER": jdbcDriver,
 			envVarPrefix + "_SSLROOTCERT": rootCertPath,
 			envVarPrefix + "_SSLCERT":     certPath,
 			envVarPrefix + "_SSLKEY":      pk1PemKeyPath,
 			envVarPrefix + "_SSLKEY_PK8":  pk8DerKeyPath,
-			envVarPrefix + "_SSLMODE":     "verify-ca",
+			envVarPrefix + "_SSLMODE":     sslMode,
+		}
+		if instanceRegion != "" {
+			envData[envVarPrefix+"_REGION"] = instanceRegion
+		}
+		if instanceProject != "" {
+			envData[envVarPrefix+"_PROJECT"] = instanceProject
+		}
+		if len(previousPassword) > 0 {
+			envData[previousPasswordKey] = previousPassword
+		}
+
+		// the direct urls are kept alongside, as e.g. migrations may need features unavailable through the pooler
+		poolerKeys := []string{envVarPrefix + "_POOLER_URL", envVarPrefix + "_POOLER_JDBC_URL"}
+		if poolerAddress != "" {
+			poolerURL := googleSQLPostgresURL
+			poolerURL.Host = poolerAddress
+			poolerJDBCURL := googleSQLJDBCURL
+			poolerJDBCURL.Host = poolerAddress
+			envData[envVarPrefix+"_POOLER_URL"] = poolerURL.String()
+			envData[envVarPrefix+"_POOLER_JDBC_URL"] = poolerJDBCURL.String()
 		}
 
+		jdbcProperties := boolAnnotation(sqlUser, jdbcPropertiesAnnotation, false)
+		jdbcCertKeys := []string{envVarPrefix + "_JDBC_SSLCERT", envVarPrefix + "_JDBC_SSLKEY", envVarPrefix + "_JDBC_SSLROOTCERT"}
+		jdbcPropertyKeys := append([]string{
+			envVarPrefix + "_JDBC_HOST",
+			envVarPrefix + "_JDBC_PORT",
+			envVarPrefix + "_JDBC_DATABASE",
+			envVarPrefix + "_JDBC_USER",
+			envVarPrefix + "_JDBC_SSLMODE",
+		}, jdbcCertKeys...)
+		if jdbcProperties {
+			envData[envVarPrefix+"_JDBC_HOST"] = instanceIP
+			envData[envVarPrefix+"_JDBC_PORT"] = postgresPort
+			envData[envVarPrefix+"_JDBC_DATABASE"] = dbName
+			envData[envVarPrefix+"_JDBC_USER"] = *sqlUser.Spec.ResourceID
+			envData[envVarPrefix+"_JDBC_SSLMODE"] = sslMode
+			if clientCertificates(sslMode) {
+				envData[envVarPrefix+"_JDBC_SSLCERT"] = urlData.CertPath
+				envData[envVarPrefix+"_JDBC_SSLKEY"] = urlData.KeyPath
+				envData[envVarPrefix+"_JDBC_SSLROOTCERT"] = urlData.RootCertPath
+			}
+		}
+
+		maxURLLength := r.MaxURLLength
+		if maxURLLength <= 0 {
+			maxURLLength = defaultMaxURLLength
+		}
+		readonlyURLKey := envVarPrefix + "_READONLY_URL"
+		if boolAnnotation(sqlUser, readonlyURLAnnotation, false) {
+			readonlyURL := makeReadonlyUrl(googleSQLPostgresURL)
+			envData[readonlyURLKey] = readonlyURL.String()
+		}
+
+		for _, key := range append([]string{envVarPrefix + "_URL", envVarPrefix + "_JDBC_URL", readonlyURLKey}, poolerKeys...) {
+			if length := len(envData[key]); length > maxURLLength {
+				logger.Info("Generated URL is longer than recommended", "key", key, "length", length, "maxLength", maxURLLength)
+				message := fmt.Sprintf("Generated %s is %d characters, longer than the recommended maximum of %d", key, length, maxURLLength)
+				if r.warnings.report(req.NamespacedName, "URLTooLong "+key, message) {
+					r.Recorder.Event(sqlUser, core_v1.EventTypeWarning, "URLTooLong", message)
+				}
+			} else {
+				r.warnings.resolve(req.NamespacedName, "URLTooLong "+key)
+			}
+			// a URL clients can't parse is worse than none, and means a bug or a value we failed to validate
+			if value, ok := envData[key]; ok {
+				if err := parseGeneratedURL(value); err != nil {
+					r.Recorder.Eventf(sqlUser, core_v1.EventTypeWarning, "InvalidURL", "Generated %s does not parse: %v", key, err)
+					return permanentFailureError(fmt.Errorf("generated %s does not parse: %w", key, err))
+				}
+			}
+		}
+
+		// merge rather than replace, as the secret may also hold keys written by the sql ssl cert controller
+		if secret.StringData == nil {
+			secret.StringData = make(map[string]string)
+		}
+		// drops keys we should no longer emit, including any previously written copies
+		dropKeys := func(keys ...string) {
+			for _, key := range keys {
+				delete(envData, key)
+				for _, k := range []string{key, fileKey(envVarPrefix, key), csiKey(envVarPrefix, key)} {
+					delete(secret.StringData, k)
+					delete(secret.Data, k)
+				}
+			}
+		}
+		if !boolAnnotation(sqlUser, emitURLsAnnotation, defaults.emitURLs()) {
+			dropKeys(envVarPrefix+"_URL", envVarPrefix+"_JDBC_URL")
+			dropKeys(poolerKeys...)
+			dropKeys(readonlyURLKey)
+		}
+		if !boolAnnotation(sqlUser, readonlyURLAnnotation, false) {
+			dropKeys(readonlyURLKey)
+		}
+		if poolerAddress == "" {
+			dropKeys(poolerKeys...)
+		}
+		if len(previousPassword) == 0 {
+			dropKeys(previousPasswordKey)
+		}
+		if !jdbcProperties {
+			dropKeys(jdbcPropertyKeys...)
+		}
+		// pgjdbc can't connect to a unix socket without a socket factory, and the socket has no port
+		if unixSocket {
+			dropKeys(envVarPrefix+"_PORT", envVarPrefix+"_JDBC_URL", envVarPrefix+"_JDBC_DRIVER")
+			dropKeys(jdbcPropertyKeys...)
+		}
+		// the urls, port and connection properties are those of postgres, so other engines only get what they share
+		if !postgres {
+			dropKeys(envVarPrefix+"_URL", envVarPrefix+"_JDBC_URL", envVarPrefix+"_PORT", envVarPrefix+"_SSLMODE")
+			dropKeys(poolerKeys...)
+			dropKeys(readonlyURLKey)
+			dropKeys(jdbcPropertyKeys...)
+		}
+		if jdbcDriver == "" {
+			dropKeys(envVarPrefix + "_JDBC_DRIVER")
+		}
+		if !clientCertificates(sslMode) {
+			dropKeys(envVarPrefix+"_SSLROOTCERT", envVarPrefix+"_SSLCERT", envVarPrefix+"_SSLKEY", envVarPrefix+"_SSLKEY_PK8")
+			dropKeys(jdbcCertKeys...)
+		}
+		dotenvKey := envVarPrefix + "_DOTENV"
+		if boolAnnotation(sqlUser, emitDotenvAnnotation, false) {
+			envData[dotenvKey] = dotenv(envData)
+		} else {
+			dropKeys(dotenvKey)
+		}
+		managedData := maps.Clone(envData)
+		if boolAnnotation(sqlUser, fileKeysAnnotation, false) {
+			for key, value := range envData {
+				managedData[fileKey(envVarPrefix, key)] = value
+			}
+		}
+		if boolAnnotation(sqlUser, csiKeysAnnotation, false) {
+			for key, value := range envData {
+				managedData[csiKey(envVarPrefix, key)] = value
+			}
+		}
+		managedKeys := make([]string, 0, len(managedData))
+		for key := range managedData {
+			managedKeys = append(managedKeys, key)
+		}
+		// users sharing a secret need different env var prefixes
+		if err := validateSharedKeys(secret, ownerReference, managedKeys); err != nil {
+			return err
+		}
+		maps.Copy(secret.StringData, managedData)
+		setManagedKeys(secret, ownerReference, managedKeys)
+		secret.Annotations[contentHashAnnotation] = contentHash(sharedUserData(secret))
+
 		return nil
 	})
 	if err != nil {
 		if errors.Is(err, errPermanentFailure) {
-			return err
+			return 0, err
+		}
+		return 0, temporaryFailureError(err)
+	}
+
+	// the secret has an owner reference again, so the finalizer from running without them is no longer needed
+	if !r.NoOwnerReferences {
+		if err := removeSecretCleanupFinalizer(ctx, r.Client, sqlUser); err != nil {
+			return 0, err
 		}
-		return temporaryFailureError(err)
+	}
+	if r.StrictOwnership && len(driftedLabels) > 0 {
+		reportLabelDrift(ctx, r.Recorder, sqlUser, secret, driftedLabels)
+	}
+	if op == controllerutil.OperationResultCreated && instanceKey.Namespace != req.Namespace {
+		r.Recorder.Eventf(sqlUser, core_v1.EventTypeNormal, "SecretNamespace", "Secret %s was created in namespace %s alongside the SQLUser, not in namespace %s of the SQLInstance", secretName, req.Namespace, instanceKey.Namespace)
 	}
 
 	logger.Info("Secret reconciled", "operation", op)
+	// come back when the password expires to replace it, or when the previous one should be cleared
+	requeueAt := passwordExpiresAt
+	if !previousPasswordExpiresAt.IsZero() && (requeueAt.IsZero() || previousPasswordExpiresAt.Before(requeueAt)) {
+		requeueAt = previousPasswordExpiresAt
+	}
+	if !requeueAt.IsZero() {
+		return requeueAt.Sub(now), nil
+	}
+	return 0, nil
+}
+
+// setServiceAccountLabel labels the secret with the service account the users of the secret ask to label it with. Users
+// sharing a secret can't label it with different ones.
+func setServiceAccountLabel(secret *core_v1.Secret) error {
+	serviceAccounts := kindOwnerAnnotations(secret, v1beta1.SQLUserGVK.Kind, serviceAccountLabelAnnotation)
+	slices.Sort(serviceAccounts)
+	serviceAccounts = slices.Compact(serviceAccounts)
+	switch len(serviceAccounts) {
+	case 0:
+		delete(secret.Labels, serviceAccountAnnotation)
+	case 1:
+		secret.Labels[serviceAccountAnnotation] = serviceAccounts[0]
+	default:
+		return permanentFailureError(fmt.Errorf("users sharing secret %s ask to label it with different service accounts: %s", secret.Name, strings.Join(serviceAccounts, ", ")))
+	}
 	return nil
 }
 
-func makePostgresUrl(postgresData UrlData) url.URL {
+// sourcePassword returns the password from the secret referenced by the password source annotation,
+// or an empty string if the user has no such annotation.
+func (r *SQLUserReconciler) sourcePassword(ctx context.Context, sqlUser *v1beta1.SQLUser) (string, error) {
+	source, ok := sqlUser.Annotations[passwordSourceSecretAnnotation]
+	if !ok {
+		return "", nil
+	}
+	name, key, ok := strings.Cut(source, "/")
+	if !ok || name == "" || key == "" {
+		return "", permanentFailureError(fmt.Errorf("invalid %s annotation %q, expected <secret>/<key>", passwordSourceSecretAnnotation, source))
+	}
+
+	secret := &core_v1.Secret{}
+	err := r.Get(ctx, types.NamespacedName{Name: name, Namespace: sqlUser.Namespace}, secret)
+	if apierrors.IsNotFound(err) {
+		return "", temporaryFailureErrorFor(reasonWaitingForPassword, fmt.Errorf("%w: password source secret %s does not exist", errMissingPassword, name))
+	}
+	if err != nil {
+		return "", temporaryFailureError(fmt.Errorf("failed to read password source secret %s: %w", name, err))
+	}
+	password, ok := secret.Data[key]
+	if !ok || len(password) == 0 {
+		return "", permanentFailureError(fmt.Errorf("password source secret %s has no key %s", name, key))
+	}
+	return string(password), nil
+}
+
+// userSSLMode returns the ssl mode from the user's annotation, falling back to the defaults.
+func userSSLMode(sqlUser *v1beta1.SQLUser, defaults Defaults) (string, error) {
+	mode, ok := sqlUser.Annotations[sslModeAnnotation]
+	if !ok {
+		return defaults.sslMode(), nil
+	}
+	if mode == sslModeDisable {
+		if !defaults.AllowSSLModeDisable {
+			return "", permanentFailureError(fmt.Errorf("ssl mode %q in annotation %s is only for testing, and not allowed by the defaults", mode, sslModeAnnotation))
+		}
+		return mode, nil
+	}
+	if !slices.Contains(supportedSSLModes, mode) {
+		return "", permanentFailureError(fmt.Errorf("unsupported ssl mode %q in annotation %s", mode, sslModeAnnotation))
+	}
+	return mode, nil
+}
+
+// validateServiceAccountName checks that the name is a valid ServiceAccount name, and a valid label value if it is
+// also used as a label.
+func validateServiceAccountName(name string, label bool) error {
+	if errs := validation.IsDNS1123Subdomain(name); len(errs) > 0 {
+		return fmt.Errorf("invalid service account name %q: %s", name, strings.Join(errs, ", "))
+	}
+	if label {
+		if errs := validation.IsValidLabelValue(name); len(errs) > 0 {
+			return fmt.Errorf("service account name %q can't be used as a label: %s", name, strings.Join(errs, ", "))
+		}
+	}
+	return nil
+}
+
+// validateDatabaseName checks that the name is a legal postgres database name that survives being used as
+// a URL path. Special characters, like spaces and slashes, are legal and are percent-encoded in the URLs.
+func validateDatabaseName(name string) error {
+	if name == "" {
+		return fmt.Errorf("database name is empty")
+	}
+	if len(name) > maxDatabaseNameLength {
+		return fmt.Errorf("database name %q is longer than %d bytes", name, maxDatabaseNameLength)
+	}
+	if strings.ContainsFunc(name, unicode.IsControl) {
+		return fmt.Errorf("database name %q contains control characters", name)
+	}
+	return nil
+}
+
+// userPoolerAddress returns the host:port of the connection pooler the user connects through,
+// or an empty string if the user has no pooler annotations. The port defaults to the postgres port.
+func userPoolerAddress(sqlUser *v1beta1.SQLUser) (string, error) {
+	host, hasHost := sqlUser.Annotations[poolerHostAnnotation]
+	port, hasPort := sqlUser.Annotations[poolerPortAnnotation]
+	if !hasHost {
+		if hasPort {
+			return "", permanentFailureError(fmt.Errorf("annotation %s requires annotation %s", poolerPortAnnotation, poolerHostAnnotation))
+		}
+		return "", nil
+	}
+	if host == "" {
+		return "", permanentFailureError(fmt.Errorf("annotation %s is empty", poolerHostAnnotation))
+	}
+	if !hasPort {
+		port = postgresPort
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return "", permanentFailureError(fmt.Errorf("invalid %s annotation %q, expected a port number", poolerPortAnnotation, port))
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// clientCertificates reports whether client certificates are used in the ssl mode.
+func clientCertificates(sslMode string) bool {
+	return sslMode != sslModeRequire && sslMode != sslModeDisable
+}
+
+// newUrlData returns the data for the connection URLs, with certificates mounted at mountPath.
+func newUrlData(instanceIP, username, password, dbName, sslMode, mountPath string) UrlData {
+	urlData := UrlData{
+		Host:         net.JoinHostPort(instanceIP, postgresPort),
+		Username:     username,
+		Password:     password,
+		Database:     dbName,
+		SSLMode:      sslMode,
+		CertPath:     filepath.Join(mountPath, certKey),
+		KeyPath:      filepath.Join(mountPath, pk1PemKeyKey),
+		RootCertPath: filepath.Join(mountPath, rootCertKey),
+	}
+	// like libpq, treat a host starting with a slash as the directory of a unix socket
+	if strings.HasPrefix(instanceIP, "/") {
+		urlData.Host = ""
+		urlData.SocketDir = instanceIP
+	}
+	if !clientCertificates(sslMode) {
+		// no client certificates in require mode, only a TLS connection, nor through the auth proxy
+		urlData.CertPath = ""
+		urlData.KeyPath = ""
+		urlData.RootCertPath = ""
+	}
+	return urlData
+}
+
+// userSSLNegotiation returns the ssl negotiation requested by the user, or an empty string for the libpq default.
+func userSSLNegotiation(sqlUser *v1beta1.SQLUser) (string, error) {
+	sslNegotiation, ok := sqlUser.Annotations[sslNegotiationAnnotation]
+	if !ok {
+		return "", nil
+	}
+	switch sslNegotiation {
+	case sslNegotiationPostgres, sslNegotiationDirect:
+		return sslNegotiation, nil
+	default:
+		return "", fmt.Errorf("unsupported ssl negotiation %q in annotation %s, must be %s or %s", sslNegotiation, sslNegotiationAnnotation, sslNegotiationPostgres, sslNegotiationDirect)
+	}
+}
+
+// withSSLNegotiation adds the ssl negotiation to a libpq url. It is left out when ssl is disabled,
+// as libpq refuses direct negotiation without ssl.
+func withSSLNegotiation(postgresURL url.URL, sslNegotiation, sslMode string) url.URL {
+	if sslNegotiation == "" || sslMode == sslModeDisable {
+		return postgresURL
+	}
+	return withQuery(postgresURL, "sslnegotiation", sslNegotiation)
+}
+
+// sharedUserData returns the keys written by every SQLUser sharing the secret, so the content hash is the same
+// whichever of them wrote it last.
+func sharedUserData(secret *core_v1.Secret) map[string]string {
+	data := make(map[string]string)
+	for name, value := range secret.Annotations {
+		if !strings.HasSuffix(name, ".sqluser."+managedKeysAnnotation) {
+			continue
+		}
+		for _, key := range splitManagedKeys(value) {
+			if value, ok := secret.StringData[key]; ok {
+				data[key] = value
+			} else {
+				data[key] = string(secret.Data[key])
+			}
+		}
+	}
+	return data
+}
+
+// ConnectionURL returns the postgres URL sqeletor generates for the user, given the instance it
+// references and the user's password. It does not talk to the cluster.
+func ConnectionURL(sqlUser *v1beta1.SQLUser, sqlInstance *v1beta1.SQLInstance, password string, defaults Defaults) (url.URL, error) {
+	dbName, ok := sqlUser.Annotations["sqeletor.nais.io/database-name"]
+	if !ok {
+		return url.URL{}, fmt.Errorf("SQLUser has no database name annotation")
+	}
+	if err := validateDatabaseName(dbName); err != nil {
+		return url.URL{}, err
+	}
+	if sqlUser.Spec.ResourceID == nil {
+		return url.URL{}, fmt.Errorf("SQLUser has no resource ID")
+	}
+	instanceIP, viaAuthProxy, err := userInstanceHost(sqlUser, sqlInstance)
+	if err != nil {
+		return url.URL{}, err
+	}
+	sslMode, err := userSSLMode(sqlUser, defaults)
+	if err != nil {
+		return url.URL{}, err
+	}
+	if viaAuthProxy {
+		sslMode = sslModeDisable
+	}
+	postgresURL := makePostgresUrl(newUrlData(instanceIP, *sqlUser.Spec.ResourceID, password, dbName, sslMode, defaults.mountPath()))
+	if targetSessionAttrs, ok := sqlUser.Annotations[targetSessionAttrsAnnotation]; ok {
+		if _, ok := targetServerTypes[targetSessionAttrs]; !ok {
+			return url.URL{}, fmt.Errorf("unsupported target session attrs %q in annotation %s", targetSessionAttrs, targetSessionAttrsAnnotation)
+		}
+		postgresURL = withQuery(postgresURL, "target_session_attrs", targetSessionAttrs)
+	}
+	sslNegotiation, err := userSSLNegotiation(sqlUser)
+	if err != nil {
+		return url.URL{}, err
+	}
+	postgresURL = withSSLNegotiation(postgresURL, sslNegotiation, sslMode)
+	if !boolAnnotation(sqlUser, urlCredentialsAnnotation, true) {
+		postgresURL.User = nil
+	}
+	return postgresURL, nil
+}
+
+// userEnvVarPrefix returns the env var prefix of the user's keys: the annotated prefix, normalized when asked for, or
+// else one normalized from the resource name.
+func userEnvVarPrefix(sqlUser *v1beta1.SQLUser) string {
+	envVarPrefix, ok := sqlUser.Annotations[envVarPrefixAnnotation]
+	if !ok {
+		return normalizeEnvVarPrefix(sqlUser.Name)
+	}
+	if boolAnnotation(sqlUser, normalizePrefixAnnotation, false) {
+		return normalizeEnvVarPrefix(envVarPrefix)
+	}
+	return envVarPrefix
+}
+
+// deriveEnvVarPrefix turns a resource name like my-app-db into an env var prefix like MY_APP_DB.
+func deriveEnvVarPrefix(name string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, strings.ToUpper(name))
+}
+
+// normalizeEnvVarPrefix turns a prefix like my-app into a valid env var name like MY_APP.
+func normalizeEnvVarPrefix(prefix string) string {
+	normalized := deriveEnvVarPrefix(prefix)
+	if normalized != "" && normalized[0] >= '0' && normalized[0] <= '9' {
+		normalized = "_" + normalized
+	}
+	return normalized
+}
+
+// contentHash returns a stable SHA-256 digest over the sorted key/value pairs.
+func contentHash(data map[string]string) string {
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	h := sha256.New()
+	for _, key := range keys {
+		h.Write([]byte(key))
+		h.Write([]byte{0})
+		h.Write([]byte(data[key]))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// fileKey turns an env var key like PREFIX_JDBC_URL into a key suitable as a file name, like jdbc-url.
+func fileKey(envVarPrefix, key string) string {
+	key = strings.TrimPrefix(key, envVarPrefix+"_")
+	return strings.ReplaceAll(strings.ToLower(key), "_", "-")
+}
+
+// dotenvEscaper escapes values for double quotes in a dotenv file. Dollar signs are escaped to prevent expansion.
+var dotenvEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `\$`, "\n", `\n`, "\r", `\r`)
+
+// dotenv formats the keys as KEY="value" lines, sorted by key so that the content doesn't change between reconciles.
+func dotenv(data map[string]string) string {
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	var b strings.Builder
+	for _, key := range keys {
+		fmt.Fprintf(&b, "%s=\"%s\"\n", key, dotenvEscaper.Replace(data[key]))
+	}
+	return b.String()
+}
+
+// csiKey turns an env var key like PREFIX_JDBC_URL into a file key under the prefix, like prefix.jdbc-url. Secret
+// keys can't hold slashes, so the dot is only a separator in the name of the file. Volumes mount the key as a file
+// named prefix.jdbc-url, unless its items map it to a path like prefix/jdbc-url.
+func csiKey(envVarPrefix, key string) string {
+	return strings.ReplaceAll(strings.ToLower(envVarPrefix), "_", "-") + "." + fileKey(envVarPrefix, key)
+}
+
+// parseGeneratedURL parses a generated URL the way clients would, looking past the jdbc: prefix of JDBC URLs.
+// The error leaves out the URL, as it holds the password.
+func parseGeneratedURL(value string) error {
+	if _, err := url.Parse(strings.TrimPrefix(value, "jdbc:")); err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			return urlErr.Err
+		}
+		return err
+	}
+	return nil
+}
+
+func sslQueries(postgresData UrlData) url.Values {
 	queries := url.Values{}
-	queries.Add("sslmode", "verify-ca")
-	queries.Add("sslcert", postgresData.CertPath)
-	queries.Add("sslkey", postgresData.KeyPath)
-	queries.Add("sslrootcert", postgresData.RootCertPath)
-	return url.URL{
+	queries.Add("sslmode", postgresData.SSLMode)
+	if postgresData.CertPath != "" {
+		queries.Add("sslcert", postgresData.CertPath)
+	}
+	if postgresData.KeyPath != "" {
+		queries.Add("sslkey", postgresData.KeyPath)
+	}
+	if postgresData.RootCertPath != "" {
+		queries.Add("sslrootcert", postgresData.RootCertPath)
+	}
+	return queries
+}
+
+func makePostgresUrl(postgresData UrlData) url.URL {
+	queries := sslQueries(postgresData)
+	if postgresData.SocketDir != "" {
+		queries.Add("host", postgresData.SocketDir)
+	}
+	return withDatabasePath(url.URL{
 		Scheme:   "postgresql",
-		Path:     postgresData.Database,
 		User:     url.UserPassword(postgresData.Username, postgresData.Password),
 		Host:     postgresData.Host,
 		RawQuery: queries.Encode(),
-	}
+	}, postgresData.Database)
+}
+
+// withDatabasePath returns a copy of the url with the database as its path. The leading slash keeps the database in
+// the path when there is no host, and slashes in the name are percent-encoded so that they stay part of it.
+func withDatabasePath(u url.URL, database string) url.URL {
+	u.Path = "/" + database
+	u.RawPath = "/" + url.PathEscape(database)
+	return u
+}
+
+// makeReadonlyUrl returns a copy of the postgres url whose sessions default to read only transactions.
+func makeReadonlyUrl(postgresURL url.URL) url.URL {
+	queries := postgresURL.Query()
+	queries.Set("options", "-c default_transaction_read_only=on")
+	// libpq does not decode '+' as a space, so spaces must be percent encoded
+	postgresURL.RawQuery = strings.ReplaceAll(queries.Encode(), "+", "%20")
+	return postgresURL
 }
 
 func makeJDBCUrl(postgresData UrlData) url.URL {
-	queries := url.Values{}
-	queries.Add("sslmode", "verify-ca")
-	queries.Add("sslcert", postgresData.CertPath)
-	queries.Add("sslkey", postgresData.KeyPath)
-	queries.Add("sslrootcert", postgresData.RootCertPath)
+	queries := sslQueries(postgresData)
 	queries.Add("user", postgresData.Username)
 	queries.Add("password", postgresData.Password)
-	return url.URL{
+	return withDatabasePath(url.URL{
 		Scheme:   "jdbc:postgresql",
-		Path:     postgresData.Database,
 		Host:     postgresData.Host,
 		RawQuery: queries.Encode(),
-	}
+	}, postgresData.Database)
+}
+
+// withQuery returns a copy of the url with the query parameter set.
+func withQuery(u url.URL, key, value string) url.URL {
+	queries := u.Query()
+	queries.Set(key, value)
+	u.RawQuery = queries.Encode()
+	return u
+}
+
+// withoutJDBCCredentials returns a copy of the jdbc url without the user and password parameters.
+func withoutJDBCCredentials(jdbcURL url.URL) url.URL {
+	queries := jdbcURL.Query()
+	queries.Del("user")
+	queries.Del("password")
+	jdbcURL.RawQuery = queries.Encode()
+	return jdbcURL
 }
 
 func (r *SQLUserReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	return ctrl.NewControllerManagedBy(mgr).
-		For(&v1beta1.SQLUser{}).
-		Complete(r)
+	b := ctrl.NewControllerManagedBy(mgr).
+		For(&v1beta1.SQLUser{}, builder.WithPredicates(labelSelectorPredicate(r.LabelSelector), relevantChangePredicate())).
+		// rebuilds the urls when the password is changed in the secret, also when the user is not its controller
+		// or owns it through the owners annotation
+		Watches(&core_v1.Secret{}, handler.EnqueueRequestsFromMapFunc(secretOwnerRequests(v1beta1.SQLUserGVK)), builder.WithPredicates(secretDataChangedPredicate()))
+	return watchTriggered(b, r.Trigger, v1beta1.SQLUserGVK, r.LabelSelector).Complete(r)
 }
 
 func generatePassword() string {
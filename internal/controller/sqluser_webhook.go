@@ -0,0 +1,107 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/GoogleCloudPlatform/k8s-config-connector/pkg/clients/generated/apis/sql/v1beta1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// SQLUserValidator rejects SQLUsers whose env var prefix is already used by another SQLUser writing to the same secret
+// in the namespace, as their keys would overwrite each other. The same prefix in distinct secrets is allowed with a
+// warning, as it is easily confused when both secrets are mounted.
+type SQLUserValidator struct {
+	Client client.Reader
+	// LabelSelector limits the validation to the users the controller reconciles, if set.
+	LabelSelector labels.Selector
+}
+
+var _ admission.CustomValidator = &SQLUserValidator{}
+
+func (v *SQLUserValidator) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(&v1beta1.SQLUser{}).
+		WithValidator(v).
+		Complete()
+}
+
+func (v *SQLUserValidator) ValidateCreate(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
+	return v.validateEnvVarPrefix(ctx, obj)
+}
+
+func (v *SQLUserValidator) ValidateUpdate(ctx context.Context, oldObj, newObj runtime.Object) (admission.Warnings, error) {
+	oldUser, ok := oldObj.(*v1beta1.SQLUser)
+	if !ok {
+		return nil, fmt.Errorf("expected a SQLUser, got %T", oldObj)
+	}
+	newUser, ok := newObj.(*v1beta1.SQLUser)
+	if !ok {
+		return nil, fmt.Errorf("expected a SQLUser, got %T", newObj)
+	}
+	// users that already conflict must still be updatable, to be fixed, and deleted through the finalizer
+	if !newUser.DeletionTimestamp.IsZero() || envVarPrefixClaim(oldUser) == envVarPrefixClaim(newUser) {
+		return nil, nil
+	}
+	return v.validateEnvVarPrefix(ctx, newObj)
+}
+
+func (v *SQLUserValidator) ValidateDelete(context.Context, runtime.Object) (admission.Warnings, error) {
+	return nil, nil
+}
+
+func (v *SQLUserValidator) validateEnvVarPrefix(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
+	sqlUser, ok := obj.(*v1beta1.SQLUser)
+	if !ok {
+		return nil, fmt.Errorf("expected a SQLUser, got %T", obj)
+	}
+	claim := envVarPrefixClaim(sqlUser)
+	if claim == (prefixClaim{}) || !selectorMatches(v.LabelSelector, sqlUser) {
+		return nil, nil
+	}
+	envVarPrefix, secretName := claim.envVarPrefix, claim.secretName
+
+	sqlUsers := &v1beta1.SQLUserList{}
+	if err := v.Client.List(ctx, sqlUsers, client.InNamespace(sqlUser.Namespace)); err != nil {
+		return nil, fmt.Errorf("listing SQLUsers: %w", err)
+	}
+	var warnings admission.Warnings
+	for i := range sqlUsers.Items {
+		other := &sqlUsers.Items[i]
+		// a user being deleted is about to release its keys
+		if other.Name == sqlUser.Name || !other.DeletionTimestamp.IsZero() || !selectorMatches(v.LabelSelector, other) {
+			continue
+		}
+		otherClaim := envVarPrefixClaim(other)
+		if otherClaim == (prefixClaim{}) || otherClaim.envVarPrefix != envVarPrefix {
+			continue
+		}
+		otherSecretName := otherClaim.secretName
+		if otherSecretName == secretName {
+			return nil, fmt.Errorf("env var prefix %s is already used by SQLUser %s in secret %s", envVarPrefix, other.Name, secretName)
+		}
+		log.FromContext(ctx).Info("Env var prefix is also used by another SQLUser", "sqlUser", sqlUser.Name, "otherSQLUser", other.Name, "envVarPrefix", envVarPrefix, "secretName", secretName, "otherSecretName", otherSecretName)
+		warnings = append(warnings, fmt.Sprintf("env var prefix %s is also used by SQLUser %s in secret %s", envVarPrefix, other.Name, otherSecretName))
+	}
+	return warnings, nil
+}
+
+// prefixClaim is the env var prefix a user writes its keys with, and the secret it writes them to.
+type prefixClaim struct {
+	envVarPrefix string
+	secretName   string
+}
+
+// envVarPrefixClaim returns the prefix and secret the user writes its keys to. Users without a database name or
+// secret ref get no keys written, and claim nothing.
+func envVarPrefixClaim(sqlUser *v1beta1.SQLUser) prefixClaim {
+	if _, ok := sqlUser.Annotations["sqeletor.nais.io/database-name"]; !ok || validateSecretKeyRef(sqlUser) != nil {
+		return prefixClaim{}
+	}
+	return prefixClaim{envVarPrefix: userEnvVarPrefix(sqlUser), secretName: sqlUser.Spec.Password.ValueFrom.SecretKeyRef.Name}
+}
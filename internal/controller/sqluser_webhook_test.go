@@ -0,0 +1,149 @@
+package controller
+
+import (
+	"context"
+
+	"github.com/GoogleCloudPlatform/k8s-config-connector/pkg/clients/generated/apis/k8s/v1alpha1"
+	"github.com/GoogleCloudPlatform/k8s-config-connector/pkg/clients/generated/apis/sql/v1beta1"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+var _ = Describe("SQLUser Validator", func() {
+	ctx := context.Background()
+
+	newUser := func(name, namespace, envVarPrefix, secretName string) *v1beta1.SQLUser {
+		user := &v1beta1.SQLUser{
+			ObjectMeta: meta_v1.ObjectMeta{
+				Name:        name,
+				Namespace:   namespace,
+				Annotations: map[string]string{"sqeletor.nais.io/database-name": "app"},
+			},
+			Spec: v1beta1.SQLUserSpec{
+				Password: &v1beta1.UserPassword{
+					ValueFrom: &v1beta1.UserValueFrom{
+						SecretKeyRef: &v1alpha1.SecretKeyRef{Name: secretName, Key: "password"},
+					},
+				},
+			},
+		}
+		if envVarPrefix != "" {
+			user.Annotations[envVarPrefixAnnotation] = envVarPrefix
+		}
+		return user
+	}
+
+	var validator *SQLUserValidator
+
+	BeforeEach(func() {
+		utilruntime.Must(v1beta1.AddToScheme(scheme.Scheme))
+		existing := newUser("existing-user", "default", "APP", "shared-secret")
+		validator = &SQLUserValidator{
+			Client: fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(existing).Build(),
+		}
+	})
+
+	It("should reject a user using a prefix already used in the same secret", func() {
+		_, err := validator.ValidateCreate(ctx, newUser("new-user", "default", "APP", "shared-secret"))
+		Expect(err).To(MatchError(ContainSubstring("env var prefix APP is already used by SQLUser existing-user in secret shared-secret")))
+	})
+
+	It("should compare the prefixes as normalized or derived", func() {
+		user := newUser("new-user", "default", "app", "shared-secret")
+		user.Annotations[normalizePrefixAnnotation] = "true"
+		_, err := validator.ValidateCreate(ctx, user)
+		Expect(err).To(MatchError(ContainSubstring("already used")))
+
+		_, err = validator.ValidateCreate(ctx, newUser("app", "default", "", "shared-secret"))
+		Expect(err).To(MatchError(ContainSubstring("already used")))
+	})
+
+	It("should reject an update changing the prefix to one already used in the same secret", func() {
+		_, err := validator.ValidateUpdate(ctx, newUser("new-user", "default", "OTHER", "shared-secret"), newUser("new-user", "default", "APP", "shared-secret"))
+		Expect(err).To(MatchError(ContainSubstring("already used")))
+	})
+
+	It("should allow updates to the user already using the prefix", func() {
+		existing := newUser("existing-user", "default", "APP", "shared-secret")
+		_, err := validator.ValidateUpdate(ctx, existing, existing)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("should allow updates to a user already conflicting that keep its prefix and secret", func() {
+		conflicting := newUser("conflicting-user", "default", "APP", "shared-secret")
+		updated := conflicting.DeepCopy()
+		updated.Labels = map[string]string{"team": "a"}
+		_, err := validator.ValidateUpdate(ctx, conflicting, updated)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("should allow updates to a conflicting user being deleted", func() {
+		conflicting := newUser("conflicting-user", "default", "OTHER", "shared-secret")
+		deleting := newUser("conflicting-user", "default", "APP", "shared-secret")
+		deleting.Finalizers = []string{secretCleanupFinalizer}
+		deleting.DeletionTimestamp = ptr.To(meta_v1.Now())
+		_, err := validator.ValidateUpdate(ctx, conflicting, deleting)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("should reject an update adding the database name to a user with a prefix already used", func() {
+		user := newUser("new-user", "default", "APP", "shared-secret")
+		withoutDatabase := user.DeepCopy()
+		delete(withoutDatabase.Annotations, "sqeletor.nais.io/database-name")
+		_, err := validator.ValidateUpdate(ctx, withoutDatabase, user)
+		Expect(err).To(MatchError(ContainSubstring("already used")))
+	})
+
+	It("should only validate users matching the label selector against each other", func() {
+		validator.LabelSelector = labels.SelectorFromSet(labels.Set{"tenant": "a"})
+
+		_, err := validator.ValidateCreate(ctx, newUser("new-user", "default", "APP", "shared-secret"))
+		Expect(err).ToNot(HaveOccurred())
+
+		selected := newUser("new-user", "default", "APP", "shared-secret")
+		selected.Labels = map[string]string{"tenant": "a"}
+		_, err = validator.ValidateCreate(ctx, selected)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("should allow distinct prefixes in the same secret", func() {
+		warnings, err := validator.ValidateCreate(ctx, newUser("new-user", "default", "OTHER", "shared-secret"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(warnings).To(BeEmpty())
+	})
+
+	It("should allow the same prefix in a distinct secret with a warning", func() {
+		warnings, err := validator.ValidateCreate(ctx, newUser("new-user", "default", "APP", "own-secret"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(warnings).To(ConsistOf(ContainSubstring("also used by SQLUser existing-user in secret shared-secret")))
+	})
+
+	It("should allow the same prefix in another namespace", func() {
+		warnings, err := validator.ValidateCreate(ctx, newUser("new-user", "other", "APP", "shared-secret"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(warnings).To(BeEmpty())
+	})
+
+	It("should allow users without a database name", func() {
+		user := newUser("new-user", "default", "APP", "shared-secret")
+		delete(user.Annotations, "sqeletor.nais.io/database-name")
+		_, err := validator.ValidateCreate(ctx, user)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("should allow using the prefix of a user being deleted", func() {
+		deleting := newUser("deleting-user", "default", "RELEASED", "shared-secret")
+		deleting.Finalizers = []string{secretCleanupFinalizer}
+		deleting.DeletionTimestamp = ptr.To(meta_v1.Now())
+		validator.Client = fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(deleting).Build()
+
+		_, err := validator.ValidateCreate(ctx, newUser("new-user", "default", "RELEASED", "shared-secret"))
+		Expect(err).ToNot(HaveOccurred())
+	})
+})